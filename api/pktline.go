@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Kinds of packet in the git pkt-line format
+const (
+	PktData = iota
+	PktFlush
+	PktDelim
+)
+
+// MaxPktPayload is the largest amount of data allowed in one packet
+const MaxPktPayload = 65516
+
+// PktlineReader reads packets in the git pkt-line format
+type PktlineReader struct {
+	r *bufio.Reader
+}
+
+// NewPktlineReader creates a reader
+func NewPktlineReader(r io.Reader) *PktlineReader {
+	return &PktlineReader{bufio.NewReader(r)}
+}
+
+// ReadPacket reads the next packet, returning its kind and any data
+func (p *PktlineReader) ReadPacket() (int, []byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(p.r, lenBuf[:]); err != nil {
+		return 0, nil, err
+	}
+	length, err := strconv.ParseUint(string(lenBuf[:]), 16, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid packet length %q", string(lenBuf[:]))
+	}
+	switch {
+	case length == 0:
+		return PktFlush, nil, nil
+	case length == 1:
+		return PktDelim, nil, nil
+	case length < 4:
+		return 0, nil, fmt.Errorf("Invalid packet length %q", string(lenBuf[:]))
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return 0, nil, err
+	}
+	return PktData, data, nil
+}
+
+// ReadText reads packets as lines of text until a flush or delim packet,
+// which is returned as the kind that ended the list
+func (p *PktlineReader) ReadText() ([]string, int, error) {
+	var lines []string
+	for {
+		kind, data, err := p.ReadPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind != PktData {
+			return lines, kind, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// DataReader returns a reader for binary data which is sent as a sequence of
+// packets terminated by a flush
+func (p *PktlineReader) DataReader() io.Reader {
+	return &pktDataReader{p: p}
+}
+
+type pktDataReader struct {
+	p    *PktlineReader
+	buf  []byte
+	done bool
+}
+
+func (d *pktDataReader) Read(b []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		kind, data, err := d.p.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if kind == PktFlush {
+			d.done = true
+		} else if kind == PktDelim {
+			return 0, errors.New("Unexpected delim packet in data")
+		}
+		d.buf = data
+	}
+	n := copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// PktlineWriter writes packets in the git pkt-line format
+type PktlineWriter struct {
+	w *bufio.Writer
+}
+
+// NewPktlineWriter creates a writer
+func NewPktlineWriter(w io.Writer) *PktlineWriter {
+	return &PktlineWriter{bufio.NewWriter(w)}
+}
+
+// WritePacket writes a data packet
+func (p *PktlineWriter) WritePacket(data []byte) error {
+	if len(data) > MaxPktPayload {
+		return fmt.Errorf("Packet too large (%d bytes)", len(data))
+	}
+	if _, err := fmt.Fprintf(p.w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+// WriteText writes lines of text, each in its own packet
+func (p *PktlineWriter) WriteText(lines ...string) error {
+	for _, line := range lines {
+		if err := p.WritePacket([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteData writes binary data split into as many packets as needed
+func (p *PktlineWriter) WriteData(r io.Reader) error {
+	buf := make([]byte, MaxPktPayload)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := p.WritePacket(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteDelim writes a delim packet
+func (p *PktlineWriter) WriteDelim() error {
+	_, err := p.w.WriteString("0001")
+	return err
+}
+
+// WriteFlush writes a flush packet and sends everything written so far
+func (p *PktlineWriter) WriteFlush() error {
+	if _, err := p.w.WriteString("0000"); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
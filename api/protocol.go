@@ -3,7 +3,6 @@ package api
 import (
 	"bufio"
 	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/sinbad/lfs-folderstore/util"
@@ -34,6 +33,7 @@ type Request struct {
 	Operation           string  `json:"operation"`
 	Concurrent          bool    `json:"concurrent"`
 	ConcurrentTransfers int     `json:"concurrenttransfers"`
+	Remote              string  `json:"remote"`
 	Oid                 string  `json:"oid"`
 	Size                int64   `json:"size"`
 	Path                string  `json:"path"`
@@ -62,7 +62,7 @@ type ProgressResponse struct {
 }
 
 // SendResponse sends an actual response to lfs
-func SendResponse(r interface{}, writer, errWriter *bufio.Writer) error {
+func SendResponse(r interface{}, writer *bufio.Writer, log *util.Logger) error {
 	b, err := json.Marshal(r)
 	if err != nil {
 		return err
@@ -74,24 +74,26 @@ func SendResponse(r interface{}, writer, errWriter *bufio.Writer) error {
 		return err
 	}
 	writer.Flush()
-	util.WriteToStderr(fmt.Sprintf("Sent message %v", string(b)), errWriter)
+	if log.Enabled(util.LogDebug) {
+		log.Debugf("Sent message %v", string(b))
+	}
 	return nil
 }
 
 // SendTransferError sends an error back to lfs
-func SendTransferError(oid string, code int, message string, writer, errWriter *bufio.Writer) {
+func SendTransferError(oid string, code int, message string, writer *bufio.Writer, log *util.Logger) {
 	resp := &TransferResponse{"complete", oid, "", &TransferError{code, message}}
-	err := SendResponse(resp, writer, errWriter)
+	err := SendResponse(resp, writer, log)
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send transfer error: %v\n", err), errWriter)
+		log.Errorf("Unable to send transfer error: %v", err)
 	}
 }
 
 // SendProgress reports progress on operations
-func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer, errWriter *bufio.Writer) {
+func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer *bufio.Writer, log *util.Logger) {
 	resp := &ProgressResponse{"progress", oid, bytesSoFar, bytesSinceLast}
-	err := SendResponse(resp, writer, errWriter)
+	err := SendResponse(resp, writer, log)
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send progress update: %v\n", err), errWriter)
+		log.Errorf("Unable to send progress update: %v", err)
 	}
 }
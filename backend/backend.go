@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var oidRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ValidOid returns whether a string is a valid SHA-256 oid
+func ValidOid(oid string) bool {
+	return oidRegex.MatchString(oid)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Oid  string
+	Size int64
+	// ModTime is when the object was last written, or zero if the backend
+	// doesn't know
+	ModTime time.Time
+}
+
+// Backend stores and retrieves objects by oid
+type Backend interface {
+	// Stat returns information about an object. If the object does not exist
+	// the error satisfies os.IsNotExist.
+	Stat(oid string) (*ObjectInfo, error)
+	// Open opens the content of an object for reading
+	Open(oid string) (io.ReadCloser, error)
+	// Create starts writing a new object, with size bytes of content or -1 if
+	// not known. Nothing is visible under the oid until the writer is
+	// committed, and then it replaces any existing object.
+	Create(oid string, size int64) (ObjectWriter, error)
+	// Delete removes an object
+	Delete(oid string) error
+	// List calls fn for every object in the store, stopping at the first error
+	List(fn func(info *ObjectInfo) error) error
+}
+
+// ObjectWriter receives the content of a new object
+type ObjectWriter interface {
+	io.Writer
+	// Commit finishes writing and makes the object visible
+	Commit() error
+	// Abort discards everything which was written
+	Abort() error
+}
+
+// FileWriter is optionally implemented by ObjectWriters which write straight
+// to a local file, so that content can be copied into it by the OS
+type FileWriter interface {
+	ObjectWriter
+	// File returns the file being written
+	File() *os.File
+}
+
+// VerifiedCache is optionally implemented by backends which can remember that
+// an object's content has been verified, so it doesn't need hashing again
+type VerifiedCache interface {
+	// Verified returns whether the object was verified and hasn't changed since
+	Verified(oid string) bool
+	// SetVerified records that the object's content is known to be good
+	SetVerified(oid string) error
+}
+
+// CorruptObjectError is returned when an object exists but can't be valid
+type CorruptObjectError struct {
+	Oid    string
+	Reason string
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("Store corruption, %v %v", e.Oid, e.Reason)
+}
+
+// Factory creates a backend from a URL
+type Factory func(u *url.URL) (Backend, error)
+
+var (
+	factoriesMutex sync.Mutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes a backend available for URLs with the given scheme
+func Register(scheme string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	factories[scheme] = factory
+}
+
+// New creates the backend for a location, which is either a plain folder path
+// or a URL such as file:///path/to/store or mem://name
+func New(location string) (Backend, error) {
+	if !strings.Contains(location, "://") {
+		return NewFolder(location)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store URL %q: %v", location, err)
+	}
+	factoriesMutex.Lock()
+	factory, ok := factories[u.Scheme]
+	factoriesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unsupported store type %q", u.Scheme)
+	}
+	return factory(u)
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Cache keeps local copies of objects as they're read from another backend,
+// which is normally a slow network store. Copies are checked against their oid
+// when they're added, and only hashed again before they're used if they have
+// changed since, going by the checksum sidecar next to each one. Anything
+// wrong is fetched again.
+//
+// Copies are of the content as read, so objects which are encrypted in the
+// store are kept decrypted in the cache.
+type Cache struct {
+	Backend
+	local *Folder
+}
+
+// NewCache adds a cache in dir in front of a backend, creating dir if needed
+func NewCache(inner Backend, dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create cache dir %q: %v", dir, err)
+	}
+	return &Cache{Backend: inner, local: &Folder{BaseDir: dir}}, nil
+}
+
+// Dir returns where the cache is kept
+func (c *Cache) Dir() string {
+	return c.local.BaseDir
+}
+
+// Stat implements Backend, answering from the cache if it has a good copy
+func (c *Cache) Stat(oid string) (*ObjectInfo, error) {
+	if c.cachedValid(oid) {
+		if info, err := c.local.Stat(oid); err == nil {
+			return info, nil
+		}
+	}
+	return c.Backend.Stat(oid)
+}
+
+// Open implements Backend, reading from the cache if it has a good copy and
+// adding a copy if it doesn't
+func (c *Cache) Open(oid string) (io.ReadCloser, error) {
+	if c.cachedValid(oid) {
+		// Touch it so Prune knows it was used recently, which means the
+		// sidecar has to be brought up to date too
+		now := time.Now()
+		os.Chtimes(c.local.path(oid), now, now)
+		c.local.SetVerified(oid)
+		if r, err := c.local.Open(oid); err == nil {
+			return r, nil
+		}
+	}
+
+	r, err := c.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.local.Create(oid, -1)
+	if err != nil {
+		// Not being able to cache never stops a read
+		return r, nil
+	}
+	return &cacheFiller{ReadCloser: r, local: c.local, oid: oid, w: w, hasher: sha256.New()}, nil
+}
+
+// cachedValid returns whether the cache has a copy of an object which matches
+// its oid, removing any copy which doesn't. A copy which hasn't changed since
+// it was last found to be good isn't hashed again.
+func (c *Cache) cachedValid(oid string) bool {
+	if c.local.Verified(oid) {
+		return true
+	}
+	f, err := c.local.Open(oid)
+	if err != nil {
+		return false
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	f.Close()
+	if err == nil && hex.EncodeToString(hasher.Sum(nil)) == oid {
+		c.local.SetVerified(oid)
+		return true
+	}
+	c.local.Delete(oid)
+	return false
+}
+
+// cacheFiller copies everything read into the cache, and only keeps it if
+// what was read matched the oid, which means it was the whole object
+type cacheFiller struct {
+	io.ReadCloser
+	local  *Folder
+	oid    string
+	w      ObjectWriter
+	hasher hash.Hash
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.w != nil && n > 0 {
+		f.hasher.Write(p[:n])
+		if _, werr := f.w.Write(p[:n]); werr != nil {
+			f.w.Abort()
+			f.w = nil
+		}
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	if f.w != nil {
+		if hex.EncodeToString(f.hasher.Sum(nil)) == f.oid {
+			if f.w.Commit() == nil {
+				f.local.SetVerified(f.oid)
+			}
+		} else {
+			f.w.Abort()
+		}
+		f.w = nil
+	}
+	return f.ReadCloser.Close()
+}
+
+// Prune removes the least recently used objects from the cache until it's no
+// bigger than limit bytes, and returns how many objects and bytes were removed
+func (c *Cache) Prune(limit int64) (int, int64, error) {
+	var objects []os.FileInfo
+	var oids []string
+	var total int64
+	err := filepath.Walk(c.local.BaseDir, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := stat.Name()
+		if stat.Mode().IsRegular() && ValidOid(name) && path == c.local.path(name) {
+			objects = append(objects, stat)
+			oids = append(oids, name)
+			total += stat.Size()
+		}
+		return nil
+	})
+	if err != nil || total <= limit {
+		return 0, 0, err
+	}
+
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return objects[order[i]].ModTime().Before(objects[order[j]].ModTime())
+	})
+	removed := 0
+	var freed int64
+	for _, i := range order {
+		if total <= limit {
+			break
+		}
+		if err := c.local.Delete(oids[i]); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		removed++
+		freed += objects[i].Size()
+		total -= objects[i].Size()
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStat(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("cached content")
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	inner := NewMemory()
+	inner.Put(oid, data)
+	cache, err := NewCache(inner, dir)
+	assert.Nil(t, err)
+
+	content, err := readAll(cache, oid)
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+	info, err := cache.Stat(oid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	// A corrupted copy isn't reported, and is removed so it's fetched again
+	path := StoragePath(dir, oid)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("something else entirely"), 0644))
+	info, err = cache.Stat(oid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// and nothing is reported for objects the store doesn't have
+	inner.Delete(oid)
+	_, err = cache.Stat(oid)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,378 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ChunksNamespace is the namespace chunks are kept in, next to the objects
+const ChunksNamespace = "chunks"
+
+// Namespaced is optionally implemented by backends which can keep another set
+// of objects alongside their own, e.g. in a subfolder
+type Namespaced interface {
+	// Namespace returns a backend for a separate set of objects
+	Namespace(name string) (Backend, error)
+}
+
+// A chunked object is stored as a manifest, which lists the chunks making up
+// its content in order. Chunks are stored under their own SHA-256 in the chunks
+// namespace, so content shared between objects is only stored once.
+//
+//	magic
+//	size <total size>
+//	<chunk sha256> <chunk size>
+//	...
+var manifestMagic = []byte("\x89LFSCDC\n")
+
+// Chunk boundaries are chosen by a gear hash of the content, so that an insert
+// or delete only changes the chunks around it. These must never change, or new
+// uploads would stop sharing chunks with existing ones.
+const (
+	chunkMin  = 256 * 1024
+	chunkMax  = 4 * 1024 * 1024
+	chunkMask = uint64(1<<20-1) << 44 // averages 1MB past the minimum
+)
+
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		h := sha256.Sum256([]byte("lfs-folderstore gear " + strconv.Itoa(i)))
+		gear[i] = binary.BigEndian.Uint64(h[:8])
+	}
+}
+
+// chunker finds chunk boundaries in a stream which arrives a piece at a time
+type chunker struct {
+	hash    uint64
+	scanned int
+}
+
+// cut returns the length of the chunk at the start of buf, or 0 if the end of
+// the chunk hasn't been seen yet
+func (c *chunker) cut(buf []byte) int {
+	// Only the last 64 bytes affect the hash, so skip what can't be a boundary
+	if skip := chunkMin - 64; c.scanned < skip {
+		c.scanned = skip
+		if c.scanned > len(buf) {
+			c.scanned = len(buf)
+		}
+	}
+	for c.scanned < len(buf) {
+		c.hash = c.hash<<1 + gear[buf[c.scanned]]
+		c.scanned++
+		if c.scanned >= chunkMax || (c.scanned >= chunkMin && c.hash&chunkMask == 0) {
+			n := c.scanned
+			c.hash, c.scanned = 0, 0
+			return n
+		}
+	}
+	return 0
+}
+
+// ChunkRef is one chunk of a chunked object
+type ChunkRef struct {
+	Hash string
+	Size int64
+}
+
+// Manifest lists the chunks which make up a chunked object
+type Manifest struct {
+	Size   int64
+	Chunks []ChunkRef
+}
+
+// ReadManifest reads the manifest of a chunked object from r. If r doesn't
+// contain a manifest, nil is returned with no error.
+func ReadManifest(r *bufio.Reader) (*Manifest, error) {
+	magic, err := r.Peek(len(manifestMagic))
+	if err != nil || !bytes.Equal(magic, manifestMagic) {
+		return nil, nil
+	}
+	r.Discard(len(manifestMagic))
+	m := &Manifest{Size: -1}
+	var total int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid manifest line %q", scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid manifest line %q", scanner.Text())
+		}
+		if fields[0] == "size" {
+			m.Size = size
+		} else if ValidOid(fields[0]) {
+			m.Chunks = append(m.Chunks, ChunkRef{fields[0], size})
+			total += size
+		} else {
+			return nil, fmt.Errorf("invalid manifest line %q", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.Size != total {
+		return nil, fmt.Errorf("manifest chunks add up to %d bytes, not %d", total, m.Size)
+	}
+	return m, nil
+}
+
+// OpenManifest reads the manifest of an object from a backend, returning nil if
+// the object isn't chunked
+func OpenManifest(storage Backend, oid string) (*Manifest, error) {
+	r, err := storage.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m, err := ReadManifest(bufio.NewReader(r))
+	if err != nil {
+		return nil, &CorruptObjectError{oid, err.Error()}
+	}
+	return m, nil
+}
+
+func (m *Manifest) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write(manifestMagic)
+	fmt.Fprintf(&buf, "size %d\n", m.Size)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(&buf, "%v %d\n", c.Hash, c.Size)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Chunked stores objects as manifests of content-defined chunks, so versions
+// of a file which are mostly the same share most of their storage. Objects
+// which aren't chunked are read through as normal, so chunking can be turned
+// on for an existing store, and chunked objects are always readable.
+type Chunked struct {
+	// Backend is where objects which aren't chunked are read and written
+	Backend
+	// Chunk is whether new objects are chunked
+	Chunk bool
+
+	// manifests are written as they are, without compression or encryption,
+	// so that gc can read them; they only contain hashes
+	raw    Backend
+	chunks Backend
+}
+
+// NewChunked creates a chunked backend. Manifests are kept in raw, chunks in
+// chunks, and objects which aren't chunked in objects, which is normally raw
+// with compression or encryption added.
+func NewChunked(raw, objects, chunks Backend, chunk bool) *Chunked {
+	return &Chunked{Backend: objects, Chunk: chunk, raw: raw, chunks: chunks}
+}
+
+// Stat implements Backend, reporting the size of the reassembled content
+func (c *Chunked) Stat(oid string) (*ObjectInfo, error) {
+	if _, err := c.raw.Stat(oid); err != nil {
+		return nil, err
+	}
+	m, err := OpenManifest(c.raw, oid)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return c.Backend.Stat(oid)
+	}
+	return &ObjectInfo{Oid: oid, Size: m.Size}, nil
+}
+
+// Open implements Backend, reassembling chunked objects
+func (c *Chunked) Open(oid string) (io.ReadCloser, error) {
+	m, err := OpenManifest(c.raw, oid)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return c.Backend.Open(oid)
+	}
+	return &chunkReader{oid: oid, chunks: c.chunks, refs: m.Chunks}, nil
+}
+
+// chunkReader reads each chunk of an object in turn, checking them as it goes
+// so a bad chunk is reported as such
+type chunkReader struct {
+	oid    string
+	chunks Backend
+	refs   []ChunkRef
+	cur    io.ReadCloser
+	ref    ChunkRef
+	read   int64
+	hasher hash.Hash
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.refs) == 0 {
+				return 0, io.EOF
+			}
+			r.ref, r.refs = r.refs[0], r.refs[1:]
+			cur, err := r.chunks.Open(r.ref.Hash)
+			if err != nil {
+				return 0, &CorruptObjectError{r.oid, fmt.Sprintf("chunk %v is unreadable: %v", r.ref.Hash, err)}
+			}
+			r.cur = cur
+			r.read = 0
+			if r.hasher == nil {
+				r.hasher = sha256.New()
+			}
+			r.hasher.Reset()
+		}
+		n, err := r.cur.Read(p)
+		r.read += int64(n)
+		r.hasher.Write(p[:n])
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if r.read != r.ref.Size || hex.EncodeToString(r.hasher.Sum(nil)) != r.ref.Hash {
+				return n, &CorruptObjectError{r.oid, fmt.Sprintf("chunk %v is corrupt", r.ref.Hash)}
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// Create implements Backend, chunking new objects if enabled
+func (c *Chunked) Create(oid string, size int64) (ObjectWriter, error) {
+	if !c.Chunk {
+		return c.Backend.Create(oid, size)
+	}
+	return &chunkWriter{c: c, oid: oid}, nil
+}
+
+// CreateResumable implements Resumable if the wrapped backend does, but only
+// when not chunking
+func (c *Chunked) CreateResumable(oid string, size int64) (ResumableWriter, []byte, error) {
+	if c.Chunk {
+		return nil, nil, ErrNotResumable
+	}
+	return CreateResumable(c.Backend, oid, size)
+}
+
+// Lock implements Locker if the wrapped backend does
+func (c *Chunked) Lock(oid string) (func(), error) {
+	return Lock(c.raw, oid)
+}
+
+type chunkWriter struct {
+	c        *Chunked
+	oid      string
+	buf      []byte
+	chunker  chunker
+	manifest Manifest
+	// reused are chunks which were already stored, which gc could remove
+	// before the manifest refers to them if no other object does
+	reused []ChunkRef
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		n := w.chunker.cut(w.buf)
+		if n == 0 {
+			break
+		}
+		if err := w.storeChunk(w.buf[:n]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// storeChunk adds a chunk to the chunk store unless it's already there
+func (w *chunkWriter) storeChunk(data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	size := int64(len(data))
+	w.manifest.Chunks = append(w.manifest.Chunks, ChunkRef{hash, size})
+	w.manifest.Size += size
+
+	if info, err := w.c.chunks.Stat(hash); err == nil && info.Size == size {
+		w.reused = append(w.reused, ChunkRef{hash, size})
+		return nil
+	}
+	cw, err := w.c.chunks.Create(hash, size)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(data); err != nil {
+		cw.Abort()
+		return err
+	}
+	return cw.Commit()
+}
+
+func (w *chunkWriter) Commit() error {
+	if len(w.buf) > 0 {
+		if err := w.storeChunk(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	// New chunks are recent enough for gc to leave alone, but ones which were
+	// already there might not be
+	for _, ref := range w.reused {
+		if info, err := w.c.chunks.Stat(ref.Hash); err != nil || info.Size != ref.Size {
+			return fmt.Errorf("Chunk %v of %v was removed while uploading", ref.Hash, w.oid)
+		}
+	}
+	mw, err := w.c.raw.Create(w.oid, -1)
+	if err != nil {
+		return err
+	}
+	if err := w.manifest.write(mw); err != nil {
+		mw.Abort()
+		return err
+	}
+	return mw.Commit()
+}
+
+func (w *chunkWriter) Abort() error {
+	// Any chunks already stored are left for gc
+	w.buf = nil
+	return nil
+}
+
+// Verified implements VerifiedCache if the wrapped backend does
+func (c *Chunked) Verified(oid string) bool {
+	if cache, ok := c.raw.(VerifiedCache); ok {
+		return cache.Verified(oid)
+	}
+	return false
+}
+
+// SetVerified implements VerifiedCache if the wrapped backend does
+func (c *Chunked) SetVerified(oid string) error {
+	if cache, ok := c.raw.(VerifiedCache); ok {
+		return cache.SetVerified(oid)
+	}
+	return nil
+}
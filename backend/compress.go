@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedMagic starts every compressed object. It's followed by the
+// uncompressed size as a big-endian uint64, then a zstd stream.
+var compressedMagic = []byte("\x89LFSZST\n")
+
+const compressedHeaderSize = 16
+
+// Compressed wraps another backend so that objects can be stored compressed
+// with zstd. Compressed objects are recognised by their header, so stores can
+// contain a mixture of compressed and uncompressed objects and both are read
+// transparently, whether or not new objects are being compressed.
+type Compressed struct {
+	Backend
+	// Compress is whether new objects are written compressed
+	Compress bool
+}
+
+// NewCompressed wraps a backend, compressing new objects if compress is true
+func NewCompressed(inner Backend, compress bool) *Compressed {
+	return &Compressed{Backend: inner, Compress: compress}
+}
+
+// readCompressedHeader returns the uncompressed size if the data in r starts
+// with a compressed header, or -1 if it doesn't
+func readCompressedHeader(r *bufio.Reader) int64 {
+	header, err := r.Peek(compressedHeaderSize)
+	if err != nil || !bytes.Equal(header[:len(compressedMagic)], compressedMagic) {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(header[len(compressedMagic):]))
+}
+
+// Stat implements Backend, reporting the uncompressed size
+func (c *Compressed) Stat(oid string) (*ObjectInfo, error) {
+	info, err := c.Backend.Stat(oid)
+	if err != nil || info.Size < compressedHeaderSize {
+		return info, err
+	}
+	r, err := c.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if size := readCompressedHeader(bufio.NewReaderSize(r, compressedHeaderSize)); size >= 0 {
+		return &ObjectInfo{Oid: oid, Size: size}, nil
+	}
+	return info, nil
+}
+
+// Open implements Backend, decompressing if necessary
+func (c *Compressed) Open(oid string) (io.ReadCloser, error) {
+	r, err := c.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	if readCompressedHeader(br) < 0 {
+		return plainReader(r, br), nil
+	}
+	br.Discard(compressedHeaderSize)
+	dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("Cannot decompress %v: %v", oid, err)
+	}
+	return &decompressReader{Decoder: dec, inner: r}, nil
+}
+
+// plainReader returns a reader for content which is stored as it is, after
+// its start was peeked at with br. Files are returned as they are, so they can
+// still be copied by the OS.
+func plainReader(r io.ReadCloser, br *bufio.Reader) io.ReadCloser {
+	if f, ok := r.(*os.File); ok {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			return f
+		}
+	}
+	return &readCloser{Reader: br, Closer: r}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type decompressReader struct {
+	*zstd.Decoder
+	inner io.Closer
+}
+
+func (d *decompressReader) Close() error {
+	d.Decoder.Close()
+	return d.inner.Close()
+}
+
+// Create implements Backend. Objects of unknown size are never compressed,
+// since the size has to be recorded up front.
+func (c *Compressed) Create(oid string, size int64) (ObjectWriter, error) {
+	if !c.Compress || size < 0 {
+		return c.Backend.Create(oid, size)
+	}
+	w, err := c.Backend.Create(oid, -1)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	binary.BigEndian.PutUint64(header[len(compressedMagic):], uint64(size))
+	if _, err := w.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &compressWriter{enc: enc, inner: w, size: size}, nil
+}
+
+// CreateResumable implements Resumable if the wrapped backend does, but only
+// when not compressing
+func (c *Compressed) CreateResumable(oid string, size int64) (ResumableWriter, []byte, error) {
+	if c.Compress && size >= 0 {
+		return nil, nil, ErrNotResumable
+	}
+	return CreateResumable(c.Backend, oid, size)
+}
+
+// Lock implements Locker if the wrapped backend does
+func (c *Compressed) Lock(oid string) (func(), error) {
+	return Lock(c.Backend, oid)
+}
+
+type compressWriter struct {
+	enc     *zstd.Encoder
+	inner   ObjectWriter
+	size    int64
+	written int64
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	n, err := w.enc.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *compressWriter) Commit() error {
+	if err := w.enc.Close(); err != nil {
+		w.inner.Abort()
+		return err
+	}
+	// The header would be wrong otherwise
+	if w.written != w.size {
+		w.inner.Abort()
+		return fmt.Errorf("Wrote %d bytes, expected %d", w.written, w.size)
+	}
+	return w.inner.Commit()
+}
+
+func (w *compressWriter) Abort() error {
+	w.enc.Close()
+	return w.inner.Abort()
+}
+
+// Verified implements VerifiedCache if the wrapped backend does
+func (c *Compressed) Verified(oid string) bool {
+	if cache, ok := c.Backend.(VerifiedCache); ok {
+		return cache.Verified(oid)
+	}
+	return false
+}
+
+// SetVerified implements VerifiedCache if the wrapped backend does
+func (c *Compressed) SetVerified(oid string) error {
+	if cache, ok := c.Backend.(VerifiedCache); ok {
+		return cache.SetVerified(oid)
+	}
+	return nil
+}
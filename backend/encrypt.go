@@ -0,0 +1,384 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize is the length of an encryption key, which is used for AES-256
+const KeySize = 32
+
+// An encrypted object is a header, then the content split into segments which
+// are each sealed with AES-GCM. Every segment except the last is full size, and
+// the last is flagged in its nonce so that truncation is detected.
+//
+//	magic (8) | version (1) | key check (8) | salt (32) | nonce prefix (7) | segments...
+//
+// Each object has its own key, derived from the configured key and the random
+// salt with HKDF-SHA256, so nonces never need to be unique across objects.
+// The whole header is authenticated along with every segment.
+var encryptedMagic = []byte("\x89LFSENC\n")
+
+const (
+	encryptedVersion    = 2
+	encryptedHeaderSize = 56
+	keyCheckSize        = 8
+	saltSize            = 32
+	noncePrefixSize     = 7
+	segmentSize         = 64 * 1024
+	tagSize             = 16
+)
+
+// KeyError is returned when an encrypted object can't be decrypted because no
+// key, or the wrong key, is configured
+type KeyError struct {
+	Oid    string
+	Reason string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("Cannot decrypt %v, %v", e.Oid, e.Reason)
+}
+
+// ParseKey decodes a key given as hex, ignoring surrounding whitespace
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("Encryption key must be %d hex characters", KeySize*2)
+	}
+	return key, nil
+}
+
+// LoadKey reads a hex key from a file
+func LoadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return key, nil
+}
+
+// keyCheck identifies a key without revealing it, so a wrong key can be
+// reported clearly rather than as a failure to authenticate
+func keyCheck(key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("lfs-folderstore key check\x00"))
+	h.Write(key)
+	return h.Sum(nil)[:keyCheckSize]
+}
+
+// objectKey derives the key for one object from the configured key and the
+// object's salt, using HKDF-SHA256 (RFC 5869)
+func objectKey(key, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("lfs-folderstore object key"))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:KeySize]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Encrypted wraps another backend so that objects are encrypted before they
+// are written to it. Unencrypted objects can still be read, so an existing
+// store can be switched over gradually. With no key, new objects are written
+// as they are and encrypted objects fail with a KeyError.
+type Encrypted struct {
+	Backend
+	key   []byte
+	check []byte
+}
+
+// NewEncrypted wraps a backend using the given key, which may be nil
+func NewEncrypted(inner Backend, key []byte) (*Encrypted, error) {
+	e := &Encrypted{Backend: inner}
+	if key == nil {
+		return e, nil
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	e.key = key
+	e.check = keyCheck(key)
+	return e, nil
+}
+
+// encryptedHeader is what's needed to decrypt the segments of an object
+type encryptedHeader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	// data is authenticated with every segment
+	data []byte
+}
+
+// readEncryptedHeader returns the header if the data in r starts with one, or
+// nil if it doesn't. An error means it can't be decrypted.
+func (e *Encrypted) readEncryptedHeader(oid string, r *bufio.Reader) (*encryptedHeader, error) {
+	start, err := r.Peek(len(encryptedMagic) + 1)
+	if err != nil || !bytes.Equal(start[:len(encryptedMagic)], encryptedMagic) {
+		return nil, nil
+	}
+	if version := start[len(encryptedMagic)]; version != encryptedVersion {
+		return nil, &CorruptObjectError{oid, fmt.Sprintf("has unknown encryption version %d", version)}
+	}
+	header, err := r.Peek(encryptedHeaderSize)
+	if err != nil {
+		return nil, &CorruptObjectError{oid, "is truncated"}
+	}
+	fields := header[len(encryptedMagic)+1:]
+	if e.key == nil {
+		return nil, &KeyError{oid, "no encryption key is configured"}
+	}
+	if !bytes.Equal(fields[:keyCheckSize], e.check) {
+		return nil, &KeyError{oid, "it was encrypted with a different key"}
+	}
+	fields = fields[keyCheckSize:]
+	h := &encryptedHeader{data: append([]byte(nil), header...)}
+	if h.aead, err = newAEAD(objectKey(e.key, fields[:saltSize])); err != nil {
+		return nil, err
+	}
+	fields = fields[saltSize:]
+	h.prefix = append([]byte(nil), fields[:noncePrefixSize]...)
+	return h, nil
+}
+
+// Stat implements Backend, reporting the size of the decrypted content
+func (e *Encrypted) Stat(oid string) (*ObjectInfo, error) {
+	info, err := e.Backend.Stat(oid)
+	if err != nil || info.Size < encryptedHeaderSize {
+		return info, err
+	}
+	r, err := e.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h, err := e.readEncryptedHeader(oid, bufio.NewReaderSize(r, encryptedHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return info, nil
+	}
+	sealed := info.Size - encryptedHeaderSize
+	segments := (sealed + segmentSize + tagSize - 1) / (segmentSize + tagSize)
+	if sealed < tagSize || sealed-segments*tagSize < 0 {
+		return nil, &CorruptObjectError{oid, "is truncated"}
+	}
+	return &ObjectInfo{Oid: oid, Size: sealed - segments*tagSize}, nil
+}
+
+// Open implements Backend, decrypting if necessary
+func (e *Encrypted) Open(oid string) (io.ReadCloser, error) {
+	r, err := e.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	h, err := e.readEncryptedHeader(oid, br)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if h == nil {
+		return plainReader(r, br), nil
+	}
+	br.Discard(encryptedHeaderSize)
+	return &decryptReader{oid: oid, aead: h.aead, prefix: h.prefix, ad: h.data, src: br, inner: r}, nil
+}
+
+type decryptReader struct {
+	oid    string
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+	src    *bufio.Reader
+	inner  io.Closer
+	index  uint32
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) nextSegment() error {
+	if d.buf == nil {
+		d.buf = make([]byte, segmentSize+tagSize)
+	}
+	n, err := io.ReadFull(d.src, d.buf)
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.src.Peek(1); err == io.EOF {
+		last = true
+	}
+	plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.prefix, d.index, last), d.buf[:n], d.ad)
+	if err != nil {
+		return &CorruptObjectError{d.oid, "failed to decrypt, the data has been damaged or modified"}
+	}
+	d.plain = plain
+	d.index++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.inner.Close()
+}
+
+// Create implements Backend, encrypting if a key is configured
+func (e *Encrypted) Create(oid string, size int64) (ObjectWriter, error) {
+	if e.key == nil {
+		return e.Backend.Create(oid, size)
+	}
+	random := make([]byte, saltSize+noncePrefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	salt, prefix := random[:saltSize], random[saltSize:]
+	aead, err := newAEAD(objectKey(e.key, salt))
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersion)
+	header = append(header, e.check...)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+
+	w, err := e.Backend.Create(oid, -1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &encryptWriter{aead: aead, prefix: prefix, ad: header, inner: w, plain: make([]byte, 0, segmentSize)}, nil
+}
+
+// CreateResumable implements Resumable if the wrapped backend does, but only
+// when not encrypting
+func (e *Encrypted) CreateResumable(oid string, size int64) (ResumableWriter, []byte, error) {
+	if e.key != nil {
+		return nil, nil, ErrNotResumable
+	}
+	return CreateResumable(e.Backend, oid, size)
+}
+
+// Lock implements Locker if the wrapped backend does
+func (e *Encrypted) Lock(oid string) (func(), error) {
+	return Lock(e.Backend, oid)
+}
+
+type encryptWriter struct {
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+	inner  ObjectWriter
+	index  uint32
+	plain  []byte
+	sealed []byte
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, because the
+		// last one has to be marked as such
+		if len(w.plain) == segmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.plain[len(w.plain):segmentSize], p)
+		w.plain = w.plain[:len(w.plain)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.prefix, w.index, last), w.plain, w.ad)
+	w.plain = w.plain[:0]
+	w.index++
+	_, err := w.inner.Write(w.sealed)
+	return err
+}
+
+func (w *encryptWriter) Commit() error {
+	if err := w.seal(true); err != nil {
+		w.inner.Abort()
+		return err
+	}
+	return w.inner.Commit()
+}
+
+func (w *encryptWriter) Abort() error {
+	return w.inner.Abort()
+}
+
+// Verified implements VerifiedCache if the wrapped backend does
+func (e *Encrypted) Verified(oid string) bool {
+	if cache, ok := e.Backend.(VerifiedCache); ok {
+		return cache.Verified(oid)
+	}
+	return false
+}
+
+// SetVerified implements VerifiedCache if the wrapped backend does
+func (e *Encrypted) SetVerified(oid string) error {
+	if cache, ok := e.Backend.(VerifiedCache); ok {
+		return cache.SetVerified(oid)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(b Backend, oid string) ([]byte, error) {
+	r, err := b.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	inner := NewMemory()
+	e, err := NewEncrypted(inner, key)
+	assert.Nil(t, err)
+
+	data := make([]byte, 3*segmentSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	oids := []string{
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"1123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	for _, oid := range oids {
+		w, err := e.Create(oid, int64(len(data)))
+		assert.Nil(t, err)
+		_, err = w.Write(data)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Commit())
+
+		content, err := readAll(e, oid)
+		assert.Nil(t, err)
+		assert.Equal(t, data, content)
+		info, err := e.Stat(oid)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), info.Size)
+	}
+
+	// Each object has its own salt, so the same content is sealed differently
+	sealed := [][]byte{inner.objects[oids[0]], inner.objects[oids[1]]}
+	assert.Equal(t, byte(encryptedVersion), sealed[0][len(encryptedMagic)])
+	assert.NotEqual(t, sealed[0][:encryptedHeaderSize], sealed[1][:encryptedHeaderSize])
+	assert.NotEqual(t, sealed[0][encryptedHeaderSize:], sealed[1][encryptedHeaderSize:])
+
+	// Changing any part of the header after the key check is detected
+	for _, offset := range []int{len(encryptedMagic) + 1 + keyCheckSize, encryptedHeaderSize - 1} {
+		damaged := append([]byte(nil), sealed[0]...)
+		damaged[offset] ^= 1
+		inner.Put(oids[0], damaged)
+		_, err = readAll(e, oids[0])
+		assert.IsType(t, &CorruptObjectError{}, err, "offset %d", offset)
+	}
+	// as is swapping in another object's header
+	swapped := append(append([]byte(nil), sealed[1][:encryptedHeaderSize]...), sealed[0][encryptedHeaderSize:]...)
+	inner.Put(oids[0], swapped)
+	_, err = readAll(e, oids[0])
+	assert.IsType(t, &CorruptObjectError{}, err)
+	// and truncation
+	inner.Put(oids[0], sealed[0][:len(sealed[0])-100])
+	_, err = readAll(e, oids[0])
+	assert.IsType(t, &CorruptObjectError{}, err)
+
+	wrong, err := NewEncrypted(inner, bytes.Repeat([]byte{8}, KeySize))
+	assert.Nil(t, err)
+	_, err = readAll(wrong, oids[1])
+	assert.IsType(t, &KeyError{}, err)
+}
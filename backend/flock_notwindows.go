@@ -0,0 +1,24 @@
+// +build !windows
+
+package backend
+
+import (
+	"os"
+	"syscall"
+)
+
+// flockFile takes flock on a lock file until it's closed, returning whether
+// it could
+func flockFile(file *os.File) bool {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
+
+// flockHeld returns whether a process may still hold flock on a lock file
+func flockHeld(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil
+}
@@ -0,0 +1,13 @@
+package backend
+
+import "os"
+
+// flockFile does nothing on Windows, which relies on the lease
+func flockFile(file *os.File) bool {
+	return false
+}
+
+// flockHeld can't tell on Windows, so assumes the owner is still there
+func flockHeld(path string) bool {
+	return true
+}
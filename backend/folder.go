@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ChecksumSuffix is appended to an object's path to name its checksum sidecar
+const ChecksumSuffix = ".sha256"
+
+var windowsDriveRegex = regexp.MustCompile("^/[A-Za-z]:")
+
+func init() {
+	Register("file", func(u *url.URL) (Backend, error) {
+		path := u.Path
+		// file:///C:/path has a path of /C:/path
+		if windowsDriveRegex.MatchString(path) {
+			path = path[1:]
+		}
+		return NewFolder(filepath.FromSlash(path))
+	})
+}
+
+// StoragePath returns where an object is kept in a folder store
+func StoragePath(baseDir string, oid string) string {
+	// Use same folder split as lfs itself
+	fld := filepath.Join(baseDir, oid[0:2], oid[2:4])
+	return filepath.Join(fld, oid)
+}
+
+// Folder stores objects as plain files in a folder, using the same layout as
+// git-lfs itself
+type Folder struct {
+	BaseDir string
+}
+
+// NewFolder creates a backend for an existing folder
+func NewFolder(baseDir string) (*Folder, error) {
+	stat, err := os.Stat(baseDir)
+	if err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("%q does not exist or is not a directory", baseDir)
+	}
+	return &Folder{BaseDir: baseDir}, nil
+}
+
+func (f *Folder) String() string {
+	return f.BaseDir
+}
+
+func (f *Folder) path(oid string) string {
+	return StoragePath(f.BaseDir, oid)
+}
+
+// Stat implements Backend
+func (f *Folder) Stat(oid string) (*ObjectInfo, error) {
+	stat, err := os.Stat(f.path(oid))
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, &CorruptObjectError{oid, fmt.Sprintf("%q is not a regular file", f.path(oid))}
+	}
+	return &ObjectInfo{Oid: oid, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Open implements Backend
+func (f *Folder) Open(oid string) (io.ReadCloser, error) {
+	return os.OpenFile(f.path(oid), os.O_RDONLY, 0644)
+}
+
+// Create implements Backend
+func (f *Folder) Create(oid string, size int64) (ObjectWriter, error) {
+	destPath := f.path(oid)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create dir %q: %v", filepath.Dir(destPath), err)
+	}
+
+	// write a temp file in same folder, then rename. The name is unique since
+	// chunks can be shared, so more than one upload may be writing the same one
+	file, err := ioutil.TempFile(filepath.Dir(destPath), oid+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open temp file for writing in %q: %v", filepath.Dir(destPath), err)
+	}
+	// TempFile is private to us, but the store is shared
+	file.Chmod(0644)
+	return &folderWriter{file: file, tempPath: file.Name(), destPath: destPath}, nil
+}
+
+type folderWriter struct {
+	file     *os.File
+	tempPath string
+	destPath string
+}
+
+func (w *folderWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// File implements FileWriter
+func (w *folderWriter) File() *os.File {
+	return w.file
+}
+
+func (w *folderWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.tempPath)
+		return fmt.Errorf("Cannot close temp file %q: %v", w.tempPath, err)
+	}
+	if err := os.Rename(w.tempPath, w.destPath); err != nil {
+		os.Remove(w.tempPath)
+		return fmt.Errorf("Error moving temp file to final location: %v", err)
+	}
+	return nil
+}
+
+func (w *folderWriter) Abort() error {
+	w.file.Close()
+	return os.Remove(w.tempPath)
+}
+
+// CreateResumable implements Resumable. The partial object and its state are
+// kept next to where the object goes, under names which are the same for
+// every attempt.
+func (f *Folder) CreateResumable(oid string, size int64) (ResumableWriter, []byte, error) {
+	destPath := f.path(oid)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, nil, fmt.Errorf("Cannot create dir %q: %v", filepath.Dir(destPath), err)
+	}
+	partPath := destPath + ".partial.tmp"
+	statePath := destPath + ".state.tmp"
+	// No state just means starting again
+	state, _ := ioutil.ReadFile(statePath)
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot open temp file for writing %q: %v", partPath, err)
+	}
+	w := &resumableWriter{folderWriter: folderWriter{file: file, tempPath: partPath, destPath: destPath}, statePath: statePath}
+	return w, state, nil
+}
+
+type resumableWriter struct {
+	folderWriter
+	statePath string
+}
+
+func (w *resumableWriter) Resume(offset int64) error {
+	stat, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < offset {
+		return fmt.Errorf("Partial file %q is %d bytes, can't resume from %d", w.tempPath, stat.Size(), offset)
+	}
+	if err := w.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (w *resumableWriter) Checkpoint(state []byte) error {
+	// State must never claim more than is really on disk
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.statePath, state, 0644)
+}
+
+func (w *resumableWriter) Suspend() error {
+	return w.file.Close()
+}
+
+func (w *resumableWriter) Commit() error {
+	err := w.folderWriter.Commit()
+	os.Remove(w.statePath)
+	return err
+}
+
+func (w *resumableWriter) Abort() error {
+	os.Remove(w.statePath)
+	return w.folderWriter.Abort()
+}
+
+// Lock implements Locker, with a lock file next to the object
+func (f *Folder) Lock(oid string) (func(), error) {
+	return lockFile(f.path(oid) + LockSuffix)
+}
+
+// Namespace implements Namespaced using a subfolder, which is only created
+// when something is stored in it
+func (f *Folder) Namespace(name string) (Backend, error) {
+	return &Folder{BaseDir: filepath.Join(f.BaseDir, name)}, nil
+}
+
+// Delete implements Backend
+func (f *Folder) Delete(oid string) error {
+	if err := os.Remove(f.path(oid)); err != nil {
+		return err
+	}
+	// Sidecar is useless without the object
+	os.Remove(f.path(oid) + ChecksumSuffix)
+	return nil
+}
+
+// List implements Backend
+func (f *Folder) List(fn func(info *ObjectInfo) error) error {
+	return filepath.Walk(f.BaseDir, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if path == f.BaseDir && os.IsNotExist(err) {
+				// Nothing stored yet
+				return nil
+			}
+			return err
+		}
+		// Only files which are exactly where we'd have stored them
+		name := stat.Name()
+		if !stat.Mode().IsRegular() || !ValidOid(name) || path != f.path(name) {
+			return nil
+		}
+		return fn(&ObjectInfo{Oid: name, Size: stat.Size(), ModTime: stat.ModTime()})
+	})
+}
+
+// AnyLocked implements LockChecker, by looking for lock files next to objects
+func (f *Folder) AnyLocked() (bool, error) {
+	locked := false
+	err := filepath.Walk(f.BaseDir, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Nothing stored yet, or the lock was released while walking
+				return nil
+			}
+			return err
+		}
+		name := strings.TrimSuffix(stat.Name(), LockSuffix)
+		if stat.Mode().IsRegular() && ValidOid(name) && path == f.path(name)+LockSuffix && !lockStale(path) {
+			locked = true
+			return io.EOF
+		}
+		return nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	return locked, err
+}
+
+// Locked implements LockChecker
+func (f *Folder) Locked(oid string) bool {
+	return Locked(f.path(oid))
+}
+
+// checksumSidecar records the details of an object at the time it was last
+// hashed, so it only needs to be hashed again if it has been changed since
+func checksumSidecar(oid string, stat os.FileInfo) string {
+	return fmt.Sprintf("%v %d %d\n", oid, stat.Size(), stat.ModTime().UnixNano())
+}
+
+// Verified implements VerifiedCache using a sidecar file next to the object
+func (f *Folder) Verified(oid string) bool {
+	stat, err := os.Stat(f.path(oid))
+	if err != nil {
+		return false
+	}
+	b, err := ioutil.ReadFile(f.path(oid) + ChecksumSuffix)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == strings.TrimSpace(checksumSidecar(oid, stat))
+}
+
+// SetVerified implements VerifiedCache
+func (f *Folder) SetVerified(oid string) error {
+	stat, err := os.Stat(f.path(oid))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path(oid)+ChecksumSuffix, []byte(checksumSidecar(oid, stat)), 0644)
+}
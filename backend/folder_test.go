@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStoragePath(t *testing.T) {
+	type args struct {
+		baseDir string
+		oid     string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		// platform-specific tests still run but use filepath.Join to make consistent
+		{
+			name: "Windows drive",
+			args: args{baseDir: `C:/Storage/Dir`, oid: "123456789abcdef"},
+			want: filepath.Join(`C:/Storage/Dir`, "12", "34", "123456789abcdef"),
+		},
+		{
+			name: "Windows drive with space",
+			args: args{baseDir: `C:/Storage Path/Dir`, oid: "123456789abcdef"},
+			want: filepath.Join(`C:/Storage Path/Dir`, "12", "34", "123456789abcdef"),
+		},
+		{
+			name: "Windows share",
+			args: args{baseDir: `\\MyServer\Storage Path\Dir`, oid: "123456789abcdef"},
+			want: filepath.Join(`\\MyServer\Storage Path\Dir`, "12", "34", "123456789abcdef"),
+		},
+		{
+			name: "Windows trailing separator",
+			args: args{baseDir: `C:/Storage/Dir/`, oid: "123456789abcdef"},
+			want: filepath.Join(`C:/Storage/Dir`, "12", "34", "123456789abcdef"),
+		},
+		{
+			name: "Unix path",
+			args: args{baseDir: `/home/bob/`, oid: "123456789abcdef"},
+			want: filepath.Join(`/home/bob`, "12", "34", "123456789abcdef"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StoragePath(tt.args.baseDir, tt.args.oid); got != tt.want {
+				t.Errorf("StoragePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LockSuffix is appended to an object's path to name the file which locks it
+// while it's being written
+const LockSuffix = ".lock"
+
+// Locker is optionally implemented by backends which can stop more than one
+// process writing the same object at once
+type Locker interface {
+	// Lock waits until nobody else is writing oid, and returns a function
+	// which must be called once this process has finished writing it
+	Lock(oid string) (func(), error)
+}
+
+// LockChecker is optionally implemented by Lockers which can tell whether
+// objects are being written
+type LockChecker interface {
+	// AnyLocked returns whether any object is locked by a write which is
+	// still running
+	AnyLocked() (bool, error)
+	// Locked returns whether oid is locked by a write which is still running
+	Locked(oid string) bool
+}
+
+// Lock locks oid in b if it supports locking, otherwise it does nothing
+func Lock(b Backend, oid string) (func(), error) {
+	if l, ok := b.(Locker); ok {
+		return l.Lock(oid)
+	}
+	return func() {}, nil
+}
+
+// Lock files are created exclusively, and hold the host and pid of their
+// owner. The owner touches the file while it holds it, and anyone else can
+// take over a lock which hasn't been touched for lockLease, which covers
+// owners which died or lost their connection to the store. flock is held on
+// the lock file as well where it's available, so a lock left by a process
+// which died on this host is taken over straight away.
+var (
+	lockLease   = 2 * time.Minute
+	lockRefresh = 30 * time.Second
+	lockPoll    = 500 * time.Millisecond
+)
+
+// Locked returns whether the object at path is locked by an upload which is
+// still running
+func Locked(path string) bool {
+	lockPath := path + LockSuffix
+	_, err := os.Stat(lockPath)
+	return err == nil && !lockStale(lockPath)
+}
+
+// LockPath locks any other file in a folder store which more than one process
+// writes to, in the same way as objects, with a lock file next to it
+func LockPath(path string) (func(), error) {
+	return lockFile(path + LockSuffix)
+}
+
+// lockFile waits until it can create path exclusively, and keeps it fresh
+// until the returned function is called
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create dir %q: %v", filepath.Dir(path), err)
+	}
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return holdLock(path, file), nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Cannot create lock file %q: %v", path, err)
+		}
+		if lockStale(path) {
+			// If someone else got there first this removes their new lock,
+			// which at worst means the same content is written twice
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+func holdLock(path string, file *os.File) func() {
+	// Only say flock is held if it is, since it isn't on every filesystem
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%v %d", host, os.Getpid())
+	if flockFile(file) {
+		owner += " flock"
+	}
+	file.WriteString(owner + "\n")
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(path)
+		file.Close()
+	}
+}
+
+// lockStale returns whether a lock file has been abandoned by its owner
+func lockStale(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		// Gone already, so just try again
+		return false
+	}
+	if time.Since(stat.ModTime()) > lockLease {
+		return true
+	}
+	owner, err := ioutil.ReadFile(path)
+	if err != nil || !strings.HasSuffix(string(owner), "\n") {
+		// Still being created
+		return false
+	}
+	// flock only means anything for owners on this host
+	fields := strings.Fields(string(owner))
+	host, _ := os.Hostname()
+	if len(fields) != 3 || fields[0] != host || fields[2] != "flock" {
+		return false
+	}
+	return !flockHeld(path)
+}
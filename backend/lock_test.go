@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	defer func(poll time.Duration) { lockPoll = poll }(lockPoll)
+	lockPoll = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-lock")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &Folder{BaseDir: dir}
+	oid := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	lockPath := store.path(oid) + LockSuffix
+
+	unlock, err := store.Lock(oid)
+	assert.Nil(t, err)
+	assert.FileExists(t, lockPath)
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := store.Lock(oid)
+		assert.Nil(t, err)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock should wait while it's held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("Lock should be taken once released")
+	}
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err), "Lock file should be removed")
+
+	take := func(msg string) {
+		done := make(chan struct{})
+		go func() {
+			unlock, err := store.Lock(oid)
+			assert.Nil(t, err)
+			unlock()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal(msg)
+		}
+	}
+
+	// Left by a process elsewhere which hasn't touched it for too long
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte("elsewhere 1 flock\n"), 0644))
+	old := time.Now().Add(-lockLease - time.Minute)
+	assert.Nil(t, os.Chtimes(lockPath, old, old))
+	take("Expired lock should be taken over")
+
+	// Left by a process on this host which no longer holds flock
+	if runtime.GOOS != "windows" {
+		host, _ := os.Hostname()
+		assert.Nil(t, ioutil.WriteFile(lockPath, []byte(fmt.Sprintf("%v 1 flock\n", host)), 0644))
+		take("Lock which isn't flocked should be taken over")
+	}
+}
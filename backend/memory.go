@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	memoriesMutex sync.Mutex
+	memories      = make(map[string]*Memory)
+)
+
+func init() {
+	Register("mem", func(u *url.URL) (Backend, error) {
+		return NamedMemory(u.Host), nil
+	})
+}
+
+// Memory keeps objects in memory, which is mostly useful for testing
+type Memory struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	namespaces map[string]*Memory
+}
+
+// NewMemory creates an empty in-memory backend
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string][]byte), namespaces: make(map[string]*Memory)}
+}
+
+// NamedMemory returns the in-memory backend for a name, which is what mem://name
+// URLs use, so that they share content within a process
+func NamedMemory(name string) *Memory {
+	memoriesMutex.Lock()
+	defer memoriesMutex.Unlock()
+	m, ok := memories[name]
+	if !ok {
+		m = NewMemory()
+		memories[name] = m
+	}
+	return m
+}
+
+func (m *Memory) notExist(oid string) error {
+	return &os.PathError{Op: "stat", Path: oid, Err: os.ErrNotExist}
+}
+
+// Stat implements Backend
+func (m *Memory) Stat(oid string) (*ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[oid]
+	if !ok {
+		return nil, m.notExist(oid)
+	}
+	return &ObjectInfo{Oid: oid, Size: int64(len(data))}, nil
+}
+
+// Open implements Backend
+func (m *Memory) Open(oid string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[oid]
+	if !ok {
+		return nil, m.notExist(oid)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Create implements Backend
+func (m *Memory) Create(oid string, size int64) (ObjectWriter, error) {
+	return &memoryWriter{m: m, oid: oid}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	m   *Memory
+	oid string
+}
+
+func (w *memoryWriter) Commit() error {
+	w.m.Put(w.oid, w.Bytes())
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+// Put sets the content of an object directly
+func (m *Memory) Put(oid string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[oid] = append([]byte(nil), data...)
+}
+
+// Namespace implements Namespaced
+func (m *Memory) Namespace(name string) (Backend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ns, ok := m.namespaces[name]
+	if !ok {
+		ns = NewMemory()
+		m.namespaces[name] = ns
+	}
+	return ns, nil
+}
+
+// Delete implements Backend
+func (m *Memory) Delete(oid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[oid]; !ok {
+		return m.notExist(oid)
+	}
+	delete(m.objects, oid)
+	return nil
+}
+
+// List implements Backend
+func (m *Memory) List(fn func(info *ObjectInfo) error) error {
+	m.mu.Lock()
+	var infos []*ObjectInfo
+	for oid, data := range m.objects {
+		infos = append(infos, &ObjectInfo{Oid: oid, Size: int64(len(data))})
+	}
+	m.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Oid < infos[j].Oid })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Mirrored keeps a copy of every object in each of several backends. Writes go
+// to all of them and succeed if at least Quorum did; reads use the first one
+// which has the object.
+type Mirrored struct {
+	Mirrors []Backend
+	// Quorum is how many mirrors a write must succeed on
+	Quorum int
+
+	mu sync.Mutex
+	// unlocked are the mirrors which couldn't be locked, for each object which
+	// is locked on the rest, and why. They aren't written to until it's
+	// unlocked, since someone else might be writing them.
+	unlocked map[string]map[int]error
+}
+
+// NewMirrored creates a backend which writes to all mirrors. A quorum of 0 or
+// more than the number of mirrors means every mirror has to be written.
+func NewMirrored(mirrors []Backend, quorum int) *Mirrored {
+	if quorum <= 0 || quorum > len(mirrors) {
+		quorum = len(mirrors)
+	}
+	return &Mirrored{Mirrors: mirrors, Quorum: quorum}
+}
+
+// Stat implements Backend. An object only exists if every mirror has it, so
+// that uploading it again fills in mirrors which are missing it.
+func (m *Mirrored) Stat(oid string) (*ObjectInfo, error) {
+	var first *ObjectInfo
+	for _, mirror := range m.Mirrors {
+		info, err := mirror.Stat(oid)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first = info
+		} else if info.Size != first.Size {
+			return nil, &os.PathError{Op: "stat", Path: oid, Err: os.ErrNotExist}
+		}
+	}
+	return first, nil
+}
+
+// Open implements Backend, reading from the first mirror which has the object
+func (m *Mirrored) Open(oid string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, mirror := range m.Mirrors {
+		r, err := mirror.Open(oid)
+		if err == nil {
+			return r, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Create implements Backend, writing to every mirror at once
+func (m *Mirrored) Create(oid string, size int64) (ObjectWriter, error) {
+	w := &mirrorWriter{quorum: m.Quorum, total: len(m.Mirrors)}
+	m.mu.Lock()
+	unlocked := m.unlocked[oid]
+	m.mu.Unlock()
+	for i, mirror := range m.Mirrors {
+		if err, ok := unlocked[i]; ok {
+			w.errs = append(w.errs, err.Error())
+			continue
+		}
+		mw, err := mirror.Create(oid, size)
+		if err != nil {
+			w.errs = append(w.errs, err.Error())
+			continue
+		}
+		w.writers = append(w.writers, mw)
+	}
+	if len(w.writers) < w.quorum {
+		w.Abort()
+		return nil, w.quorumError(len(w.writers))
+	}
+	return w, nil
+}
+
+// Lock implements Locker, locking the object on every mirror which supports it
+// in turn. Mirrors which can't be locked count as failed, so the lock is only
+// taken if at least Quorum mirrors could be locked, and until it's released
+// writes skip the others.
+func (m *Mirrored) Lock(oid string) (func(), error) {
+	var unlocks []func()
+	unlockAll := func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+	unlocked := make(map[int]error)
+	var errs []string
+	for i, mirror := range m.Mirrors {
+		unlock, err := Lock(mirror, oid)
+		if err != nil {
+			unlocked[i] = err
+			errs = append(errs, err.Error())
+			continue
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	if len(unlocks) < m.Quorum {
+		unlockAll()
+		return nil, fmt.Errorf("Only %d of %d mirrors could be locked, %d needed: %v", len(unlocks), len(m.Mirrors), m.Quorum, strings.Join(errs, "; "))
+	}
+
+	m.mu.Lock()
+	if m.unlocked == nil {
+		m.unlocked = make(map[string]map[int]error)
+	}
+	m.unlocked[oid] = unlocked
+	m.mu.Unlock()
+	return func() {
+		// Before unlocking, since anyone waiting for the lock in this process
+		// sets their own
+		m.mu.Lock()
+		delete(m.unlocked, oid)
+		m.mu.Unlock()
+		unlockAll()
+	}, nil
+}
+
+type mirrorWriter struct {
+	writers []ObjectWriter
+	quorum  int
+	total   int
+	errs    []string
+}
+
+func (w *mirrorWriter) quorumError(written int) error {
+	return fmt.Errorf("Only %d of %d mirrors could be written, %d needed: %v", written, w.total, w.quorum, strings.Join(w.errs, "; "))
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	// Drop mirrors as they fail, so one bad mirror doesn't stop the others
+	ok := w.writers[:0]
+	for _, mw := range w.writers {
+		if _, err := mw.Write(p); err != nil {
+			w.errs = append(w.errs, err.Error())
+			mw.Abort()
+			continue
+		}
+		ok = append(ok, mw)
+	}
+	w.writers = ok
+	if len(w.writers) < w.quorum {
+		return 0, w.quorumError(len(w.writers))
+	}
+	return len(p), nil
+}
+
+func (w *mirrorWriter) Commit() error {
+	written := 0
+	for _, mw := range w.writers {
+		if err := mw.Commit(); err != nil {
+			w.errs = append(w.errs, err.Error())
+			continue
+		}
+		written++
+	}
+	w.writers = nil
+	if written < w.quorum {
+		return w.quorumError(written)
+	}
+	return nil
+}
+
+func (w *mirrorWriter) Abort() error {
+	for _, mw := range w.writers {
+		mw.Abort()
+	}
+	w.writers = nil
+	return nil
+}
+
+// Delete implements Backend, deleting from every mirror which has the object
+func (m *Mirrored) Delete(oid string) error {
+	var firstErr error
+	deleted := false
+	for _, mirror := range m.Mirrors {
+		if err := mirror.Delete(oid); err == nil {
+			deleted = true
+		} else if !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil && !deleted {
+		firstErr = &os.PathError{Op: "remove", Path: oid, Err: os.ErrNotExist}
+	}
+	return firstErr
+}
+
+// List implements Backend, listing every object which is on any mirror
+func (m *Mirrored) List(fn func(info *ObjectInfo) error) error {
+	seen := make(map[string]bool)
+	for _, mirror := range m.Mirrors {
+		err := mirror.List(func(info *ObjectInfo) error {
+			if seen[info.Oid] {
+				return nil
+			}
+			seen[info.Oid] = true
+			return fn(info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unlockable is a mirror which can't be locked, like a folder on a share
+// which has gone read-only
+type unlockable struct {
+	*Memory
+}
+
+func (u *unlockable) Lock(oid string) (func(), error) {
+	return nil, errors.New("cannot create lock file")
+}
+
+func writeObject(t *testing.T, b Backend, oid string, data []byte) error {
+	w, err := b.Create(oid, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	return w.Commit()
+}
+
+func TestMirroredLock(t *testing.T) {
+	oid := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	data := []byte("mirrored")
+	good := []*Memory{NewMemory(), NewMemory()}
+	bad := &unlockable{NewMemory()}
+	m := NewMirrored([]Backend{good[0], bad, good[1]}, 2)
+
+	// A mirror which can't be locked isn't written while the others are
+	unlock, err := Lock(m, oid)
+	assert.Nil(t, err)
+	assert.Nil(t, writeObject(t, m, oid, data))
+	unlock()
+	for _, mirror := range good {
+		_, err := mirror.Stat(oid)
+		assert.Nil(t, err)
+	}
+	_, err = bad.Stat(oid)
+	assert.NotNil(t, err)
+
+	// and counts against the quorum
+	all := NewMirrored([]Backend{good[0], bad, good[1]}, 3)
+	unlock, err = Lock(all, oid)
+	assert.Nil(t, unlock)
+	assert.Contains(t, err.Error(), "Only 2 of 3 mirrors could be locked, 3 needed: cannot create lock file")
+
+	// Once unlocked, writes go everywhere again
+	assert.Nil(t, writeObject(t, m, oid, data))
+	_, err = bad.Stat(oid)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,39 @@
+package backend
+
+import "errors"
+
+// ErrNotResumable is returned by CreateResumable when an object can't be
+// written resumably, so Create should be used instead
+var ErrNotResumable = errors.New("Resumable writes are not supported")
+
+// Resumable is optionally implemented by backends which can keep a partly
+// written object when a transfer is interrupted, so a later attempt can carry
+// on from where it stopped
+type Resumable interface {
+	// CreateResumable is like Create, but picks up any partial object left
+	// by an earlier attempt. It also returns the state that attempt last
+	// saved with Checkpoint, or nil if there is none.
+	CreateResumable(oid string, size int64) (ResumableWriter, []byte, error)
+}
+
+// ResumableWriter receives the content of an object which can be resumed
+type ResumableWriter interface {
+	ObjectWriter
+	// Resume discards anything after offset, and continues writing there.
+	// It must be called before anything is written.
+	Resume(offset int64) error
+	// Checkpoint makes sure everything written so far is kept, and saves
+	// state alongside it to be returned by CreateResumable next time
+	Checkpoint(state []byte) error
+	// Suspend stops writing, keeping everything up to the last checkpoint
+	Suspend() error
+}
+
+// CreateResumable calls CreateResumable on b if it supports it, otherwise it
+// returns ErrNotResumable
+func CreateResumable(b Backend, oid string, size int64) (ResumableWriter, []byte, error) {
+	if r, ok := b.(Resumable); ok {
+		return r.CreateResumable(oid, size)
+	}
+	return nil, nil, ErrNotResumable
+}
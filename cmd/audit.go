@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditOid   string
+	auditUser  string
+	auditSince string
+	auditUntil string
+	auditJSON  bool
+)
+
+func newAuditCmd() *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:   "audit <basedir>",
+		Short: "Show who uploaded and downloaded objects in a store",
+		Run:   auditCommand,
+	}
+	auditCmd.Flags().StringVarP(&auditOid, "oid", "", "", "Only show transfers of this object")
+	auditCmd.Flags().StringVarP(&auditUser, "user", "u", "", "Only show transfers by this user")
+	auditCmd.Flags().StringVarP(&auditSince, "since", "", "", "Only show transfers at or after this time")
+	auditCmd.Flags().StringVarP(&auditUntil, "until", "", "", "Only show transfers before this time")
+	auditCmd.Flags().BoolVarP(&auditJSON, "json", "", false, "Write entries as JSON lines")
+	auditCmd.SetUsageFunc(auditUsageCommand)
+	return auditCmd
+}
+
+func auditUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore audit [options] <basedir>
+
+Arguments:
+  basedir      Base directory of the object store (required)
+
+Options:
+  --oid <oid>         Only show transfers of this object
+  -u, --user <user>   Only show transfers by this user
+  --since <time>      Only show transfers at or after this time, either a date
+                      (2006-01-02, midnight UTC) or a full RFC 3339 time
+                      (2006-01-02T15:04:05Z)
+  --until <time>      Only show transfers before this time
+  --json              Write each entry as a JSON object instead of a line of
+                      text
+
+Lists the transfers recorded in the store's audit log, oldest first. Transfers
+are only recorded by clients which pass --audit in the args.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+// parseAuditTime accepts a date or a full timestamp
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, expected 2006-01-02 or 2006-01-02T15:04:05Z", s)
+	}
+	return t, nil
+}
+
+func auditCommand(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		os.Stderr.WriteString("Required: base directory")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	baseDir := strings.TrimSpace(args[0])
+	q := service.AuditQuery{Oid: auditOid, User: auditUser}
+	var err error
+	if len(auditSince) > 0 {
+		if q.Since, err = parseAuditTime(auditSince); err != nil {
+			os.Stderr.WriteString(err.Error())
+			cmd.Usage()
+			os.Exit(2)
+		}
+	}
+	if len(auditUntil) > 0 {
+		if q.Until, err = parseAuditTime(auditUntil); err != nil {
+			os.Stderr.WriteString(err.Error())
+			cmd.Usage()
+			os.Exit(2)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	err = service.QueryAudit(baseDir, q, func(entry *service.AuditEntry) error {
+		if auditJSON {
+			return enc.Encode(entry)
+		}
+		outcome := entry.Outcome
+		if len(entry.Error) > 0 {
+			outcome = fmt.Sprintf("%v (%d: %v)", outcome, entry.Code, entry.Error)
+		}
+		remote := entry.Remote
+		if len(remote) == 0 {
+			remote = "-"
+		}
+		_, err := fmt.Printf("%v %v@%v %v %v %d %v %v %v\n", entry.Time.Format(time.RFC3339), entry.User, entry.Host,
+			entry.Operation, entry.Oid, entry.Size, entry.Repo, remote, outcome)
+		return err
+	})
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to read audit log of %q: %v\n", baseDir, err))
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/spf13/cobra"
+)
+
+var cacheSize string
+
+func newCacheCmd() *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage a local cache of downloaded objects",
+	}
+	pruneCmd := &cobra.Command{
+		Use:   "prune --size <size> <cachedir>",
+		Short: "Remove the least recently used objects from a cache",
+		Run:   cachePruneCommand,
+	}
+	pruneCmd.Flags().StringVarP(&cacheSize, "size", "s", "0", "Size to reduce the cache to")
+	pruneCmd.SetUsageFunc(cacheUsageCommand)
+	cacheCmd.SetUsageFunc(cacheUsageCommand)
+	cacheCmd.AddCommand(pruneCmd)
+	return cacheCmd
+}
+
+func cacheUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore cache prune [options] <cachedir>
+
+Arguments:
+  cachedir     Cache directory, as given to --cache-dir
+
+Options:
+  -s, --size <size>   Size to reduce the cache to, e.g. 500M or 20G. Objects
+                      which were used least recently are removed first. 0
+                      empties the cache.
+
+The cache is also pruned to --cache-size automatically after each run, once
+git-lfs has finished all its transfers.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func cachePruneCommand(cmd *cobra.Command, args []string) {
+	var cacheDir string
+	if len(args) > 0 {
+		cacheDir = strings.TrimSpace(args[0])
+	}
+	if len(cacheDir) == 0 {
+		os.Stderr.WriteString("Required: cache directory")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	stat, err := os.Stat(cacheDir)
+	if err != nil || !stat.IsDir() {
+		os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", cacheDir))
+		cmd.Usage()
+		os.Exit(2)
+	}
+	limit, err := util.ParseSize(cacheSize)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	cache, err := backend.NewCache(nil, cacheDir)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(2)
+	}
+	removed, freed, err := cache.Prune(limit)
+	fmt.Printf("Removed %d objects, %d bytes\n", removed, freed)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to prune %q: %v\n", cacheDir, err))
+		os.Exit(1)
+	}
+}
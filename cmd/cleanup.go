@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cleanupAgeArg string
+	cleanupDryRun bool
+)
+
+func newCleanupCmd() *cobra.Command {
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup <basedir> [<repo>...]",
+		Short: "Remove temp files left behind by interrupted transfers",
+		Run:   cleanupCommand,
+	}
+	cleanupCmd.Flags().StringVarP(&cleanupAgeArg, "age", "", "24h", "Only remove temp files older than this")
+	cleanupCmd.Flags().BoolVarP(&cleanupDryRun, "dry-run", "n", false, "Report what would be removed without removing it")
+	cleanupCmd.SetUsageFunc(cleanupUsageCommand)
+	return cleanupCmd
+}
+
+func cleanupUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore cleanup [options] <basedir> [<repo>...]
+
+Arguments:
+  basedir      Base directory of the object store (required)
+  repo         Path to a git repository whose partial downloads in .git/lfs/tmp
+               should be cleaned up too, can be given more than once
+
+Options:
+  --age <age>         Only remove temp files which haven't been written to for
+                      this long, e.g. 30m or 48h. Partial uploads and downloads
+                      of large objects are kept until then so they can be
+                      resumed (default: 24h)
+  -n, --dry-run       Report what would be removed but don't remove it
+
+Temp files of objects which are being uploaded are always kept. Locks which
+have been abandoned are removed whatever their age.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func cleanupCommand(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		os.Stderr.WriteString("Required: base directory")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	baseDir := strings.TrimSpace(args[0])
+	age, err := time.ParseDuration(cleanupAgeArg)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	report, err := service.Cleanup(baseDir, args[1:], age, cleanupDryRun)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to clean up %q: %v\n", baseDir, err))
+		os.Exit(2)
+	}
+
+	action := "Removed"
+	if cleanupDryRun {
+		action = "Would remove"
+	}
+	failed := 0
+	for _, file := range report.Removed {
+		if file.Error != nil {
+			fmt.Printf("Failed to remove %v: %v\n", file.Path, file.Error)
+			failed++
+		} else {
+			fmt.Printf("%v %v (%d bytes)\n", action, file.Path, file.Size)
+		}
+	}
+	if report.InUse > 0 {
+		fmt.Printf("Kept %d temp files of objects being uploaded\n", report.InUse)
+	}
+	fmt.Printf("%v %d files, %d bytes\n", action, len(report.Removed)-failed, report.RemovedBytes)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
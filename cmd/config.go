@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/spf13/cobra"
+)
+
+// Settings of the root command are read from each of these in turn, later
+// ones overriding earlier ones:
+//
+//	.lfsconfig    lfs-folderstore.basedir in the repository's .lfsconfig file
+//	git config    lfs-folderstore.<key> in the usual git config files
+//	environment   LFS_FOLDERSTORE_<KEY> variables
+//	flags         --<key> on the command line, or the basedir argument
+//
+// The keys are the flag names, without dashes in git config (cachedir) and
+// in upper case with underscores in the environment (CACHE_DIR). The base
+// directory of a remote can also be set with lfs-folderstore.<remote>.basedir.
+const (
+	configSection = "lfs-folderstore"
+	envPrefix     = "LFS_FOLDERSTORE_"
+)
+
+// Where a setting came from, in order of precedence
+const (
+	fromDefault = iota
+	fromLfsConfig
+	fromGitConfig
+	fromEnvironment
+	fromFlags
+)
+
+// configFlags are the flags of the root command which are settings
+var configFlags = []string{
+	"basedir", "checksum-cache", "compress", "chunk", "key-file", "cache-dir",
+	"cache-size", "mirror", "quorum", "fallback", "backfill", "cleanup-age",
+	"log-level", "log-json", "log-file", "upload-limit", "download-limit",
+	"limit", "remote-basedir", "audit", "fast-copy",
+}
+
+// lfsConfigFlags are the only settings read from .lfsconfig. It is committed
+// to the repository, so anyone who can push to it could otherwise choose e.g.
+// the key file or log file of everyone who clones it; like git-lfs, only where
+// the objects are is taken from it, along with lfs-folderstore.<remote>.basedir.
+var lfsConfigFlags = []string{"basedir"}
+
+// config is the value of every setting, from whichever layer set it last
+type config struct {
+	values  map[string][]string
+	sources map[string]int
+}
+
+func (c *config) set(name string, values []string, source int) {
+	if len(values) > 0 && source >= c.sources[name] {
+		c.values[name] = values
+		c.sources[name] = source
+	}
+}
+
+// str returns the last value of a setting, or blank if it isn't set
+func (c *config) str(name string) string {
+	values := c.values[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+func (c *config) strs(name string) []string {
+	return c.values[name]
+}
+
+func (c *config) boolean(name string) (bool, error) {
+	value := c.str(name)
+	switch strings.ToLower(value) {
+	case "", "true", "yes", "on", "1":
+		return len(c.values[name]) > 0, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid value %q for %v, expected true or false", value, name)
+}
+
+func (c *config) integer(name string) (int, error) {
+	value := c.str(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %q for %v, expected a number", value, name)
+	}
+	return n, nil
+}
+
+// loadConfig reads the settings for every flag of cmd from each layer, with
+// args being the positional arguments
+func loadConfig(cmd *cobra.Command, args []string) (*config, error) {
+	c := &config{values: make(map[string][]string), sources: make(map[string]int)}
+	// Settings which can be given more than once
+	multi := make(map[string]bool)
+	for _, name := range configFlags {
+		multi[name] = cmd.Flags().Lookup(name).Value.Type() == "stringArray"
+	}
+
+	// .lfsconfig is shared through the repository, so it only applies when
+	// there is one, and only to base directories
+	if top, err := util.GitTopLevel(); err == nil {
+		lfsConfig := filepath.Join(top, ".lfsconfig")
+		if _, err := os.Stat(lfsConfig); err == nil {
+			if err := c.loadGitConfig(lfsConfig, lfsConfigFlags, fromLfsConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := c.loadGitConfig("", configFlags, fromGitConfig); err != nil {
+		return nil, err
+	}
+
+	for _, name := range configFlags {
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1)))
+		if !ok {
+			continue
+		}
+		if multi[name] {
+			// Lists are separated by commas
+			c.set(name, strings.Split(value, ","), fromEnvironment)
+		} else {
+			c.set(name, []string{value}, fromEnvironment)
+		}
+	}
+
+	for _, name := range configFlags {
+		if !cmd.Flags().Changed(name) {
+			continue
+		}
+		if multi[name] {
+			values, err := cmd.Flags().GetStringArray(name)
+			if err != nil {
+				return nil, err
+			}
+			c.set(name, values, fromFlags)
+		} else {
+			c.set(name, []string{cmd.Flags().Lookup(name).Value.String()}, fromFlags)
+		}
+	}
+	if len(args) > 0 {
+		c.set("basedir", []string{args[0]}, fromFlags)
+	}
+	return c, nil
+}
+
+// loadGitConfig reads the settings in names, and the base directories of
+// remotes, from the lfs-folderstore section of git config, or of file if it
+// isn't blank
+func (c *config) loadGitConfig(file string, names []string, source int) error {
+	values, err := util.GitConfigValues(file, `^`+configSection+`\.`)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		c.set(name, values[configSection+"."+strings.Replace(name, "-", "", -1)], source)
+	}
+	// Base directories of remotes are in subsections, which keep their case
+	for key, dirs := range values {
+		parts := strings.Split(key, ".")
+		if len(parts) < 3 || parts[len(parts)-1] != "basedir" {
+			continue
+		}
+		remote := strings.Join(parts[1:len(parts)-1], ".")
+		c.set("remote-basedir:"+remote, dirs, source)
+	}
+	return nil
+}
+
+// serviceConfig turns the settings into what Serve needs
+func (c *config) serviceConfig() (service.Config, error) {
+	var cfg service.Config
+	var err error
+	cfg.BaseDir = c.str("basedir")
+	// Without a default, each remote's base directory has to be configured,
+	// which Serve reports when git-lfs starts using one that isn't
+	if len(cfg.BaseDir) > 0 {
+		if _, err := backend.New(cfg.BaseDir); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.RemoteBaseDirs, err = c.remoteBaseDirs(); err != nil {
+		return cfg, err
+	}
+
+	bools := map[string]*bool{
+		"checksum-cache": &cfg.ChecksumCache,
+		"compress":       &cfg.Compress,
+		"chunk":          &cfg.Chunk,
+		"backfill":       &cfg.BackFill,
+		"fast-copy":      &cfg.FastCopy,
+		"log-json":       &cfg.LogJSON,
+		"audit":          &cfg.Audit,
+	}
+	for name, value := range bools {
+		if *value, err = c.boolean(name); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Quorum, err = c.integer("quorum"); err != nil {
+		return cfg, err
+	}
+	if cfg.EncryptionKey, err = c.encryptionKey(); err != nil {
+		return cfg, err
+	}
+
+	cfg.CacheDir = c.str("cache-dir")
+	if cacheSize := c.str("cache-size"); len(cacheSize) > 0 {
+		if cfg.CacheLimit, err = util.ParseSize(cacheSize); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Mirrors = c.strs("mirror")
+	cfg.Fallbacks = c.strs("fallback")
+	if cleanupAge := c.str("cleanup-age"); len(cleanupAge) > 0 {
+		if cfg.CleanupAge, err = time.ParseDuration(cleanupAge); err != nil {
+			return cfg, err
+		}
+	}
+	if logLevel := c.str("log-level"); len(logLevel) > 0 {
+		if cfg.LogLevel, err = util.ParseLogLevel(logLevel); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.LogFile = c.str("log-file")
+
+	// --limit is for whichever of the others isn't set
+	for _, limit := range []struct {
+		name  string
+		value *int64
+	}{{"upload-limit", &cfg.UploadLimit}, {"download-limit", &cfg.DownloadLimit}} {
+		value := c.str(limit.name)
+		if len(value) == 0 {
+			value = c.str("limit")
+		}
+		if len(value) == 0 {
+			continue
+		}
+		if *limit.value, err = util.ParseSize(value); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// remoteBaseDirs returns the base directory of each remote which has one, from
+// --remote-basedir and its equivalents, and lfs-folderstore.<remote>.basedir
+func (c *config) remoteBaseDirs() (map[string]string, error) {
+	dirs := make(map[string]string)
+	sources := make(map[string]int)
+	for _, value := range c.strs("remote-basedir") {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("Invalid remote base directory %q, expected <remote>=<dir>", value)
+		}
+		remote := strings.TrimSpace(parts[0])
+		dirs[remote] = strings.TrimSpace(parts[1])
+		sources[remote] = c.sources["remote-basedir"]
+	}
+	for name := range c.values {
+		if !strings.HasPrefix(name, "remote-basedir:") {
+			continue
+		}
+		remote := strings.TrimPrefix(name, "remote-basedir:")
+		if _, ok := dirs[remote]; !ok || c.sources[name] > sources[remote] {
+			dirs[remote] = c.str(name)
+		}
+	}
+	return dirs, nil
+}
+
+// encryptionKey returns the key from the key file, or from LFS_FOLDERSTORE_KEY,
+// which overrides a key file set in git config like any other environment
+// variable
+func (c *config) encryptionKey() ([]byte, error) {
+	if c.sources["key-file"] < fromEnvironment && len(os.Getenv(keyEnvVar)) > 0 {
+		return loadKey("")
+	}
+	return loadKey(c.str("key-file"))
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inTempRepo runs fn in a new repository, with the user's own git config
+// kept out of it, passing it a function which runs git there
+func inTempRepo(t *testing.T, fn func(repo string, git func(args ...string) string)) {
+	repo, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-repo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(repo)
+	for name, value := range map[string]string{"HOME": repo, "XDG_CONFIG_HOME": repo, "GIT_CONFIG_NOSYSTEM": "1"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	defer os.Chdir(wd)
+	assert.Nil(t, os.Chdir(repo))
+
+	git := func(args ...string) string {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.Nil(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", ".")
+	fn(repo, git)
+}
+
+func TestLoadConfigLfsConfig(t *testing.T) {
+	inTempRepo(t, func(repo string, git func(args ...string) string) {
+		lfsConfig := filepath.Join(repo, ".lfsconfig")
+		git("config", "-f", lfsConfig, "lfs-folderstore.basedir", "/mnt/lfs")
+		git("config", "-f", lfsConfig, "lfs-folderstore.origin.basedir", "/mnt/origin")
+		// None of these may come from the repository
+		git("config", "-f", lfsConfig, "lfs-folderstore.mirror", "/tmp/evil")
+		git("config", "-f", lfsConfig, "lfs-folderstore.logfile", "/tmp/evil.log")
+		git("config", "-f", lfsConfig, "lfs-folderstore.keyfile", "/tmp/evil.key")
+		git("config", "-f", lfsConfig, "lfs-folderstore.remotebasedir", "backup=/tmp/evil")
+		// but they can from git config
+		git("config", "lfs-folderstore.cachedir", "/tmp/cache")
+
+		c, err := loadConfig(RootCmd, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "/mnt/lfs", c.str("basedir"))
+		assert.Empty(t, c.strs("mirror"))
+		assert.Empty(t, c.str("log-file"))
+		assert.Empty(t, c.str("key-file"))
+		assert.Empty(t, c.strs("remote-basedir"))
+		assert.Equal(t, "/tmp/cache", c.str("cache-dir"))
+		assert.Equal(t, "/mnt/origin", c.str("remote-basedir:origin"))
+	})
+}
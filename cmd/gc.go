@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcRefs     []string
+	gcSince    string
+	gcTrashDir string
+	gcDryRun   bool
+)
+
+func newGcCmd() *cobra.Command {
+	gcCmd := &cobra.Command{
+		Use:   "gc <basedir> <repo>...",
+		Short: "Remove objects from a store which no repository refers to",
+		Run:   gcCommand,
+	}
+	gcCmd.Flags().StringArrayVarP(&gcRefs, "ref", "r", nil, "Ref to keep objects for (default all refs)")
+	gcCmd.Flags().StringVarP(&gcSince, "since", "", "", "Only keep objects from commits since this date")
+	gcCmd.Flags().StringVarP(&gcTrashDir, "trash", "", "", "Move objects to this folder instead of deleting them")
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "n", false, "Report what would be removed without removing it")
+	gcCmd.SetUsageFunc(gcUsageCommand)
+	return gcCmd
+}
+
+func gcUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore gc [options] <basedir> <repo>...
+
+Arguments:
+  basedir      Base directory of the object store (required)
+  repo         Path to a git repository which uses the store, at least one is
+               required. Every repository using the store must be listed, any
+               object only used by an unlisted repository will be removed!
+
+Options:
+  -r, --ref <ref>     Keep objects referenced by this ref, can be given more
+                      than once (default: all refs)
+  --since <date>      Only keep objects referenced by commits since this date,
+                      as accepted by git e.g. "90.days.ago". Objects at the tip
+                      of each ref are always kept. Default: all history
+  --trash <dir>       Move unreferenced objects to this folder rather than
+                      deleting them. Should be outside the store. Chunked
+                      objects are moved with a copy of their chunks, so the
+                      trash can be read like any other store
+  -n, --dry-run       Report what would be removed but don't remove it
+
+Unreferenced objects are only removed once they are an hour old, since a push
+uploads objects before the commits which refer to them, and not while they are
+being uploaded. Chunks which no object uses are also only removed once they
+are an hour old, and not while anything is being uploaded to the store, since
+an upload stores its chunks before the object which uses them.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func gcCommand(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		os.Stderr.WriteString("Required: base directory and at least one repository")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	baseDir := strings.TrimSpace(args[0])
+	storage, err := backend.New(baseDir)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(2)
+	}
+	var trash backend.Backend
+	if len(gcTrashDir) > 0 && !gcDryRun {
+		if !strings.Contains(gcTrashDir, "://") {
+			os.MkdirAll(gcTrashDir, 0755)
+		}
+		if trash, err = backend.New(gcTrashDir); err != nil {
+			os.Stderr.WriteString(err.Error())
+			os.Exit(2)
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, repo := range args[1:] {
+		oids, err := service.ReferencedOids(repo, gcRefs, gcSince)
+		if err != nil {
+			// Never remove anything unless we know everything that's in use
+			os.Stderr.WriteString(fmt.Sprintf("Unable to read LFS references from %q: %v\n", repo, err))
+			os.Exit(2)
+		}
+		for oid := range oids {
+			referenced[oid] = true
+		}
+	}
+
+	report, err := service.GarbageCollect(storage, referenced, trash, gcDryRun)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to garbage collect %q: %v\n", baseDir, err))
+		os.Exit(2)
+	}
+
+	action := "Removed"
+	if gcDryRun {
+		action = "Would remove"
+	} else if len(gcTrashDir) > 0 {
+		action = "Moved to trash"
+	}
+	failed, failedChunks := 0, 0
+	for _, obj := range report.Unreferenced {
+		if obj.Error != nil {
+			fmt.Printf("Failed to remove %v: %v\n", obj.Oid, obj.Error)
+			failed++
+		} else {
+			fmt.Printf("%v %v (%d bytes)\n", action, obj.Oid, obj.Size)
+		}
+	}
+	for _, chunk := range report.UnreferencedChunks {
+		if chunk.Error != nil {
+			fmt.Printf("Failed to remove chunk %v: %v\n", chunk.Oid, chunk.Error)
+			failedChunks++
+		}
+	}
+	fmt.Printf("%d objects in store, %d referenced\n", report.Objects, report.Referenced)
+	if report.KeptObjects > 0 {
+		fmt.Printf("Kept %d unreferenced objects which are less than an hour old or being uploaded\n", report.KeptObjects)
+	}
+	if report.Chunks > 0 {
+		fmt.Printf("%d chunks in store, %d unused\n", report.Chunks, len(report.UnreferencedChunks)+report.KeptChunks)
+		if report.KeptChunks > 0 {
+			fmt.Printf("Kept %d unused chunks which are less than an hour old or may be in use by an upload\n", report.KeptChunks)
+		}
+	}
+	fmt.Printf("%v %d objects, %d chunks, %d bytes\n", action, len(report.Unreferenced)-failed,
+		len(report.UnreferencedChunks)-failedChunks, report.RemovedBytes)
+	if failed > 0 || failedChunks > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/spf13/cobra"
+)
+
+// Name the custom transfer agent is configured under. An agent installed for
+// one remote gets the remote's name appended, so each can have its own args.
+const agentName = "lfs-folder"
+
+var installRemote string
+
+func newInstallCmd() *cobra.Command {
+	installCmd := &cobra.Command{
+		Use:   "install [--remote <name>] <basedir>",
+		Short: "Configure the current repository to use a folder store",
+		Run:   installCommand,
+	}
+	installCmd.Flags().StringVarP(&installRemote, "remote", "r", "", "Only use the folder store for this remote")
+	installCmd.SetUsageFunc(installUsageCommand)
+	return installCmd
+}
+
+func newUninstallCmd() *cobra.Command {
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall [--remote <name>]",
+		Short: "Remove folder store configuration from the current repository",
+		Run:   uninstallCommand,
+	}
+	uninstallCmd.Flags().StringVarP(&installRemote, "remote", "r", "", "Remove configuration for this remote")
+	uninstallCmd.SetUsageFunc(installUsageCommand)
+	return uninstallCmd
+}
+
+func installUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore install [options] <basedir>
+  lfs-folderstore uninstall [options]
+
+Arguments:
+  basedir      Base directory for the object store (required)
+
+Options:
+  -r, --remote <name>   Only use the folder store for this remote, other remotes
+                        keep using the standard LFS API. By default the folder
+                        store is used for all remotes.
+
+Must be run inside the git repository to configure. Running install again
+replaces the previous configuration. A remote installed with --remote gets its
+own agent, lfs-folder-<name>, so it can use a different folder to the rest.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+// agentFor returns the name of the agent for one remote or for everything
+func agentFor(remote string) string {
+	if len(remote) == 0 {
+		return agentName
+	}
+	return fmt.Sprintf("%v-%v", agentName, remote)
+}
+
+// standaloneKey returns the git config key which selects our agent, for one
+// remote or for everything
+func standaloneKey(remote string) (string, error) {
+	if len(remote) == 0 {
+		return "lfs.standalonetransferagent", nil
+	}
+	url, err := util.GitConfigGet(fmt.Sprintf("remote.%v.url", remote))
+	if err != nil {
+		return "", err
+	}
+	if len(url) == 0 {
+		return "", fmt.Errorf("Remote %q does not exist or has no URL", remote)
+	}
+	return fmt.Sprintf("lfs.%v.standalonetransferagent", url), nil
+}
+
+func installCommand(cmd *cobra.Command, args []string) {
+	var baseDir string
+	if len(args) > 0 {
+		baseDir = strings.TrimSpace(args[0])
+	}
+	if len(baseDir) == 0 {
+		os.Stderr.WriteString("Required: base directory")
+		cmd.Usage()
+		os.Exit(1)
+	}
+	baseDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid base directory %q: %v\n", args[0], err))
+		os.Exit(1)
+	}
+	stat, err := os.Stat(baseDir)
+	if err != nil || !stat.IsDir() {
+		os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", baseDir))
+		cmd.Usage()
+		os.Exit(3)
+	}
+
+	settings, err := install(baseDir, installRemote)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+	for _, setting := range settings {
+		fmt.Printf("%v = %v\n", setting[0], setting[1])
+	}
+}
+
+// install configures the repository in the current directory to use the
+// folder store in baseDir, for one remote or for all of them, and returns the
+// settings it made
+func install(baseDir, remote string) ([][]string, error) {
+	key, err := standaloneKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	// git-lfs prefers forward slashes even on Windows
+	args, err := util.QuoteArg(filepath.ToSlash(baseDir))
+	if err != nil {
+		return nil, err
+	}
+	agent := agentFor(remote)
+	settings := [][]string{
+		{fmt.Sprintf("lfs.customtransfer.%v.path", agent), "lfs-folderstore"},
+		{fmt.Sprintf("lfs.customtransfer.%v.args", agent), args},
+		{key, agent},
+	}
+	for _, setting := range settings {
+		if err := util.GitConfigSet(setting[0], setting[1]); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func uninstallCommand(cmd *cobra.Command, args []string) {
+	keptFor, err := uninstall(installRemote)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+	agent := agentFor(installRemote)
+	if len(keptFor) > 0 {
+		fmt.Printf("Still in use by %v, keeping %v configuration\n", keptFor, agent)
+		return
+	}
+	fmt.Printf("Removed %v configuration\n", agent)
+}
+
+// uninstall stops the repository in the current directory using the folder
+// store, for one remote or for all of them. The agent itself is kept if
+// something else still uses it, in which case that setting's key is returned.
+func uninstall(remote string) (string, error) {
+	key, err := standaloneKey(remote)
+	if err != nil {
+		return "", err
+	}
+	agent := agentFor(remote)
+	if err := util.GitConfigUnset(key, fmt.Sprintf("^%v$", regexp.QuoteMeta(agent))); err != nil {
+		return "", err
+	}
+
+	remaining, err := util.GitConfigLocalKeys(`^lfs\..*standalonetransferagent$`)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range remaining {
+		if v == agent {
+			return k, nil
+		}
+	}
+	for _, setting := range []string{"path", "args"} {
+		if err := util.GitConfigUnset(fmt.Sprintf("lfs.customtransfer.%v.%v", agent, setting), ""); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstall(t *testing.T) {
+	inTempRepo(t, func(repo string, git func(args ...string) string) {
+		argsKey := "lfs.customtransfer." + agentName + ".args"
+		store := filepath.ToSlash(filepath.Join(repo, "bob's store"))
+		assert.Nil(t, os.Mkdir(store, 0755))
+
+		_, err := install(store, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "lfs-folderstore", git("config", "lfs.customtransfer."+agentName+".path"))
+		assert.Equal(t, `"`+store+`"`, git("config", argsKey))
+		assert.Equal(t, agentName, git("config", "lfs.standalonetransferagent"))
+
+		// A path git-lfs couldn't pass on is refused, leaving things as they were
+		_, err = install(filepath.Join(repo, `bob's "store"`), "")
+		assert.Contains(t, err.Error(), "both single and double quotes")
+		assert.Equal(t, `"`+store+`"`, git("config", argsKey))
+
+		// One remote as well as everything, each with its own folder
+		git("remote", "add", "origin", "/srv/repo.git")
+		plain := filepath.ToSlash(filepath.Join(repo, "plain store"))
+		_, err = install(plain, "origin")
+		assert.Nil(t, err)
+		assert.Equal(t, `"`+store+`"`, git("config", argsKey))
+		assert.Equal(t, "lfs-folderstore", git("config", "lfs.customtransfer."+agentName+"-origin.path"))
+		assert.Equal(t, "'"+plain+"'", git("config", "lfs.customtransfer."+agentName+"-origin.args"))
+		assert.Equal(t, agentName+"-origin", git("config", "lfs./srv/repo.git.standalonetransferagent"))
+		keptFor, err := uninstall("origin")
+		assert.Nil(t, err)
+		assert.Empty(t, keptFor)
+		assert.Equal(t, `"`+store+`"`, git("config", argsKey))
+		assert.Equal(t, agentName, git("config", "lfs.standalonetransferagent"))
+		remaining, err := util.GitConfigLocalKeys(`^lfs\.customtransfer\.` + agentName + `-origin\.`)
+		assert.Nil(t, err)
+		assert.Empty(t, remaining)
+
+		// The agent for everything is kept while something else selects it
+		git("config", "lfs./srv/other.git.standalonetransferagent", agentName)
+		keptFor, err = uninstall("")
+		assert.Nil(t, err)
+		assert.Equal(t, "lfs./srv/other.git.standalonetransferagent", keptFor)
+		assert.Equal(t, `"`+store+`"`, git("config", argsKey))
+		git("config", "--unset", "lfs./srv/other.git.standalonetransferagent")
+
+		keptFor, err = uninstall("")
+		assert.Nil(t, err)
+		assert.Empty(t, keptFor)
+		remaining, err = util.GitConfigLocalKeys(`^lfs\.`)
+		assert.Nil(t, err)
+		assert.Empty(t, remaining)
+	})
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+func newMirrorStatusCmd() *cobra.Command {
+	mirrorStatusCmd := &cobra.Command{
+		Use:   "mirror-status <basedir> <mirror>...",
+		Short: "Report which objects each mirror of a store is missing",
+		Run:   mirrorStatusCommand,
+	}
+	mirrorStatusCmd.SetUsageFunc(mirrorStatusUsageCommand)
+	return mirrorStatusCmd
+}
+
+func mirrorStatusUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore mirror-status <basedir> <mirror>...
+
+Arguments:
+  basedir      Base directory of the object store
+  mirror       Each mirror of the store, as given to --mirror
+
+Lists every store and reports the objects which each one is missing that any
+of the others has. A JSON report is written to stdout, and the exit code is 1
+if any store is lagging behind or can't be read. Uploading with every store
+available again fills in what's missing.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func mirrorStatusCommand(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		os.Stderr.WriteString("Required: base directory and at least one mirror")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	var locations []string
+	for _, arg := range args {
+		locations = append(locations, strings.TrimSpace(arg))
+	}
+
+	report := service.CompareMirrors(locations)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -23,16 +23,18 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/sinbad/lfs-folderstore/backend"
 	"github.com/sinbad/lfs-folderstore/service"
 	"github.com/spf13/cobra"
 )
 
-var (
-	baseDir      string
-	printVersion bool
-)
+var printVersion bool
+
+// keyEnvVar can hold the encryption key instead of a key file
+const keyEnvVar = "LFS_FOLDERSTORE_KEY"
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd *cobra.Command
@@ -40,6 +42,11 @@ var RootCmd *cobra.Command
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// Behave as the SSH transfer server if we've been installed under its name
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if name == sshTransferName {
+		RootCmd.SetArgs(append([]string{sshTransferName}, os.Args[1:]...))
+	}
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -54,25 +61,155 @@ func init() {
 		as the remote store for all LFS object data. Upload and download functions
 		are turned into simple file copies to destinations determined by the id
 		of the object.`,
-		Run: rootCommand,
+		// basedir isn't a subcommand, even though there are subcommands
+		Args: cobra.ArbitraryArgs,
+		Run:  rootCommand,
 	}
 
-	RootCmd.Flags().StringVarP(&baseDir, "basedir", "d", "", "Base directory for all file operations")
-	RootCmd.Flags().BoolVarP(&printVersion, "version", "", false, "Print version")
+	// Settings are only read from the flags once the other layers of
+	// configuration are loaded, see loadConfig
+	flags := RootCmd.Flags()
+	flags.StringP("basedir", "d", "", "Base directory for all file operations")
+	flags.BoolVarP(&printVersion, "version", "", false, "Print version")
+	flags.Bool("checksum-cache", false, "Cache object checksums in sidecar files")
+	flags.Bool("compress", false, "Compress new objects with zstd")
+	flags.Bool("chunk", false, "Store new objects as deduplicated chunks")
+	flags.String("key-file", "", "File containing the encryption key")
+	flags.String("cache-dir", "", "Local folder to cache downloaded objects in")
+	flags.String("cache-size", "0", "Size to keep the cache under")
+	flags.StringArray("mirror", nil, "Another store to keep a copy of every object in")
+	flags.Int("quorum", 0, "How many stores an upload must succeed on")
+	flags.StringArray("fallback", nil, "Read-only store to download missing objects from")
+	flags.Bool("backfill", false, "Copy objects found in a fallback store to basedir")
+	flags.String("cleanup-age", "", "Remove temp files older than this when starting")
+	flags.String("log-level", "info", "Most verbose log entries to write")
+	flags.Bool("log-json", false, "Write log entries as JSON")
+	flags.String("log-file", "", "File to append log entries to instead of stderr")
+	flags.String("upload-limit", "", "Most bytes per second to upload")
+	flags.String("download-limit", "", "Most bytes per second to download")
+	flags.String("limit", "", "Most bytes per second to upload and to download")
+	flags.StringArray("remote-basedir", nil, "Base directory for one remote, as <remote>=<dir>")
+	flags.Bool("audit", false, "Record every transfer in the store's audit log")
+	flags.Bool("fast-copy", false, "Let the OS copy objects using reflinks or copy_file_range")
 	RootCmd.SetUsageFunc(usageCommand)
 
+	RootCmd.AddCommand(
+		newVerifyCmd(),
+		newGcCmd(),
+		newCacheCmd(),
+		newCleanupCmd(),
+		newAuditCmd(),
+		newMirrorStatusCmd(),
+		newInstallCmd(),
+		newUninstallCmd(),
+		newServeHTTPCmd(),
+		newSSHTransferCmd(),
+	)
+
 }
 
 func usageCommand(cmd *cobra.Command) error {
 	usage := `
 Usage:
-  lfs-folderstore [options] <basedir>
+  lfs-folderstore [options] [<basedir>]
 
 Arguments:
-  basedir      Base directory for the object store (required)
+  basedir      Base directory for the object store. Can also be a URL to
+               select a different type of store, e.g. file:///path. Only
+               optional if every remote has its own base directory
+
+Commands:
+  verify       Check the integrity of every object in a store
+  gc           Remove objects from a store which no repository refers to
+  mirror-status
+               Report which objects each mirror of a store is missing
+  cache prune  Remove the least recently used objects from a local cache
+  cleanup      Remove temp files left behind by interrupted transfers
+  audit        Show who uploaded and downloaded objects in a store
+  install      Configure the current repository to use a folder store
+  uninstall    Remove folder store configuration from the current repository
+  serve-http   Serve a store using the standard git-lfs HTTP API
+  git-lfs-transfer
+               Serve a store over SSH, run by git-lfs on the server
 
 Options:
-  --version    Report the version number and exit
+  --version          Report the version number and exit
+  --checksum-cache   Record the SHA-256 of verified objects in a sidecar file
+                     next to each one, so unchanged objects which are uploaded
+                     again don't have to be re-read to check them
+  --compress         Compress new objects with zstd when they're stored.
+                     Compressed objects are always read, with or without this
+  --chunk            Split new objects into content-defined chunks, which are
+                     only stored once however many objects contain them. Good
+                     for large files which change a little at a time. Chunked
+                     objects are always read, with or without this
+  --cache-dir <dir>  Keep a copy of every downloaded object in a local folder,
+                     which can be shared by every clone on the machine, so
+                     objects are only read from the store once. Copies are
+                     checked when they're added, and again if they change.
+                     Encrypted objects are cached decrypted, so keep the
+                     folder somewhere only you can read
+  --cache-size <size>
+                     Remove the least recently used objects from the cache
+                     after each run to keep it under this size, e.g. 20G
+  --remote-basedir <remote>=<dir>
+                     Use a different base directory for one git remote, e.g.
+                     --remote-basedir backup=/mnt/backup/lfs. Can be given
+                     more than once. Remotes without one use
+                     lfs-folderstore.<remote>.basedir from git config if it's
+                     set, otherwise basedir
+  --mirror <dir>     Another store to write every uploaded object to as well
+                     as basedir. Can be given more than once. Downloads use
+                     basedir first, and the mirrors in order if an object is
+                     missing or corrupt
+  --quorum <n>       How many of the stores, including basedir, an upload has
+                     to succeed on when using mirrors (default: all)
+  --fallback <dir>   A store to download objects from if basedir and the
+                     mirrors don't have them, e.g. one which has been migrated
+                     from. Can be given more than once, and they're tried in
+                     order. Nothing is ever written to a fallback store
+  --backfill         Copy objects which were downloaded from a fallback store
+                     into basedir, so it's not needed next time
+  --key-file <file>  Encrypt new objects with the key in this file, which is
+                     64 hex characters (e.g. from openssl rand -hex 32). The
+                     key can also be given in the LFS_FOLDERSTORE_KEY
+                     environment variable. Encrypted objects can't be read
+                     without it, unencrypted objects can always be read
+  --fast-copy        When the store and repo are on the same filesystem, copy
+                     objects with a reflink (btrfs, XFS) or copy_file_range
+                     rather than reading and writing them. Linux only, and
+                     not used for compressed, encrypted or chunked objects
+  --cleanup-age <age>
+                     When starting, remove temp files which interrupted
+                     transfers left in the store and the repository more than
+                     this long ago, e.g. 24h. Temp files of objects which are
+                     being uploaded are always kept
+  --log-level <level>
+                     How much to log: error, warn, info (the default) or
+                     debug, which includes every message sent to git-lfs
+  --log-json         Write each log entry as a JSON object, with fields for
+                     the oid, size, duration, throughput and error code of
+                     each transfer
+  --log-file <file>  Append log entries to this file instead of writing them
+                     to stderr, where git-lfs only shows them with GIT_TRACE
+  --upload-limit <size>
+                     Upload no more than this many bytes per second in total,
+                     however many transfers are running, e.g. 10M
+  --download-limit <size>
+                     Download no more than this many bytes per second in total
+  --limit <size>     Both of the above, for whichever isn't given separately
+  --audit            Append a line to audit.log in basedir for every transfer,
+                     with the time, user, host, repository, remote, object,
+                     size and outcome. Use the audit command to query it
+
+Configuration:
+  Every option can also be set in git config, as lfs-folderstore.<option>
+  without dashes (e.g. lfs-folderstore.cachedir), or in the environment as
+  LFS_FOLDERSTORE_<OPTION> in upper case with underscores (e.g.
+  LFS_FOLDERSTORE_CACHE_DIR), with lists separated by commas. basedir is
+  lfs-folderstore.basedir. Only lfs-folderstore.basedir and
+  lfs-folderstore.<remote>.basedir are read from .lfsconfig. Flags override
+  the environment, which overrides git config, which overrides .lfsconfig.
 
 Note:
   This tool should only be called by git-lfs as documented in Custom Transfers:
@@ -90,20 +227,33 @@ func rootCommand(cmd *cobra.Command, args []string) {
 		os.Stderr.WriteString(fmt.Sprintf("lfs-folder %v\n", Version))
 		os.Exit(0)
 	}
-	var baseDir string
-	if len(args) > 0 {
-		baseDir = strings.TrimSpace(args[0])
-	}
-	if len(baseDir) == 0 {
-		os.Stderr.WriteString("Required: base directory")
+	c, err := loadConfig(cmd, args)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
 		cmd.Usage()
-		os.Exit(1)
+		os.Exit(3)
 	}
-	stat, err := os.Stat(baseDir)
-	if err != nil || !stat.IsDir() {
-		os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", baseDir))
+	cfg, err := c.serviceConfig()
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
 		cmd.Usage()
 		os.Exit(3)
 	}
-	service.Serve(baseDir, os.Stdin, os.Stdout, os.Stderr)
+	service.Serve(cfg, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// loadKey returns the key in file, or from the environment if file is blank,
+// or nil if neither is set
+func loadKey(file string) ([]byte, error) {
+	if len(file) > 0 {
+		return backend.LoadKey(file)
+	}
+	if env := os.Getenv(keyEnvVar); len(env) > 0 {
+		key, err := backend.ParseKey(env)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", keyEnvVar, err)
+		}
+		return key, nil
+	}
+	return nil, nil
 }
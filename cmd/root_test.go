@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootArgs(t *testing.T) {
+	// git-lfs runs the root command with the base directory as its argument,
+	// which mustn't be mistaken for an unknown subcommand
+	cmd, args, err := RootCmd.Find([]string{"/tmp/store"})
+	assert.Nil(t, err)
+	assert.Equal(t, RootCmd, cmd)
+	assert.Equal(t, []string{"/tmp/store"}, args)
+	assert.Nil(t, cmd.ValidateArgs(args))
+
+	cmd, args, err = RootCmd.Find([]string{"verify", "/tmp/store"})
+	assert.Nil(t, err)
+	assert.Equal(t, "verify", cmd.Name())
+	assert.Equal(t, []string{"/tmp/store"}, args)
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	httpListen  string
+	httpKeyFile string
+)
+
+func newServeHTTPCmd() *cobra.Command {
+	serveHTTPCmd := &cobra.Command{
+		Use:   "serve-http [--listen <addr>] <basedir>",
+		Short: "Serve a store using the standard git-lfs HTTP API",
+		Run:   serveHTTPCommand,
+	}
+	serveHTTPCmd.Flags().StringVarP(&httpListen, "listen", "l", "localhost:8080", "Address to listen on")
+	serveHTTPCmd.Flags().StringVarP(&httpKeyFile, "key-file", "", "", "File containing the encryption key")
+	serveHTTPCmd.SetUsageFunc(serveHTTPUsageCommand)
+	return serveHTTPCmd
+}
+
+func serveHTTPUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore serve-http [options] <basedir>
+
+Arguments:
+  basedir      Base directory for the object store (required)
+
+Options:
+  -l, --listen <addr>   Address to listen on (default: localhost:8080)
+  --key-file <file>     Key for encrypted objects. LFS_FOLDERSTORE_KEY is used
+                        if not given.
+
+Serves the LFS batch API with basic transfers, so that any LFS client can use
+the store. Set lfs.url to http://<addr>/ (or any path beneath it). There is no
+authentication, so use a reverse proxy if it needs to be exposed.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func serveHTTPCommand(cmd *cobra.Command, args []string) {
+	var baseDir string
+	if len(args) > 0 {
+		baseDir = strings.TrimSpace(args[0])
+	}
+	if len(baseDir) == 0 {
+		os.Stderr.WriteString("Required: base directory")
+		cmd.Usage()
+		os.Exit(1)
+	}
+	key, err := loadKey(httpKeyFile)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(3)
+	}
+	storage, err := service.OpenStore(baseDir, service.Options{EncryptionKey: key})
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(3)
+	}
+
+	os.Stderr.WriteString(fmt.Sprintf("Serving %q on http://%v/\n", baseDir, httpListen))
+	err = http.ListenAndServe(httpListen, service.HTTPHandler(storage))
+	os.Stderr.WriteString(fmt.Sprintf("Server stopped: %v\n", err))
+	os.Exit(1)
+}
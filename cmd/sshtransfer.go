@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/spf13/cobra"
+)
+
+// Name git-lfs runs on the remote end of an SSH connection
+const sshTransferName = "git-lfs-transfer"
+
+var (
+	sshBaseDir string
+	sshKeyFile string
+)
+
+func newSSHTransferCmd() *cobra.Command {
+	sshTransferCmd := &cobra.Command{
+		Use:   sshTransferName + " [--basedir <dir>] <path> <operation>",
+		Short: "Serve a store over SSH, as git-lfs-transfer",
+		Run:   sshTransferCommand,
+	}
+	sshTransferCmd.Flags().StringVarP(&sshBaseDir, "basedir", "d", "", "Base directory of the object store")
+	sshTransferCmd.Flags().StringVarP(&sshKeyFile, "key-file", "", "", "File containing the encryption key")
+	sshTransferCmd.SetUsageFunc(sshTransferUsageCommand)
+	return sshTransferCmd
+}
+
+func sshTransferUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore git-lfs-transfer [options] <path> <operation>
+
+Arguments:
+  path         Path of the git repository, as requested by the client
+  operation    upload or download
+
+Options:
+  -d, --basedir <dir>   Base directory for the object store. If not given, it
+                        is read from lfs-folderstore.basedir in the repository's
+                        git config.
+  --key-file <file>     Key for encrypted objects. LFS_FOLDERSTORE_KEY is used
+                        if not given.
+
+This is run by git-lfs on the remote end of an SSH connection. Install a
+git-lfs-transfer executable on the server's path which runs this command, or
+link git-lfs-transfer to lfs-folderstore, and clients need no configuration.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func sshTransferCommand(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		os.Stderr.WriteString("Required: path and operation")
+		cmd.Usage()
+		os.Exit(1)
+	}
+	repoPath, operation := args[0], args[1]
+
+	baseDir := strings.TrimSpace(sshBaseDir)
+	if len(baseDir) == 0 {
+		if err := os.Chdir(repoPath); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Cannot access repository %q: %v\n", repoPath, err))
+			os.Exit(3)
+		}
+		dir, err := util.GitConfigGet("lfs-folderstore.basedir")
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+			os.Exit(3)
+		}
+		baseDir = dir
+	}
+	if len(baseDir) == 0 {
+		os.Stderr.WriteString("Base directory not specified, check config\n")
+		os.Exit(3)
+	}
+	key, err := loadKey(sshKeyFile)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(3)
+	}
+	storage, err := service.OpenStore(baseDir, service.Options{EncryptionKey: key})
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(3)
+	}
+
+	if err := service.ServeSSH(storage, operation, os.Stdin, os.Stdout); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyJobs    int
+	verifyKeyFile string
+)
+
+func newVerifyCmd() *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:   "verify <basedir>",
+		Short: "Check the integrity of every object in a store",
+		Run:   verifyCommand,
+	}
+	verifyCmd.Flags().IntVarP(&verifyJobs, "jobs", "j", runtime.NumCPU(), "Number of objects to check in parallel")
+	verifyCmd.Flags().StringVarP(&verifyKeyFile, "key-file", "", "", "File containing the encryption key")
+	verifyCmd.SetUsageFunc(verifyUsageCommand)
+	return verifyCmd
+}
+
+func verifyUsageCommand(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  lfs-folderstore verify [options] <basedir>
+
+Arguments:
+  basedir      Base directory of the object store to check (required)
+
+Options:
+  -j, --jobs          Number of objects to check in parallel (default: number
+                      of CPUs)
+  --key-file <file>   Key to check encrypted objects with, if the store has
+                      any. LFS_FOLDERSTORE_KEY is used if not given.
+
+Every object in the store is re-hashed and checked against its oid. Misplaced,
+empty and non-regular objects, leftover temp files and unknown files are also
+reported. Temp files of objects which are being uploaded are left alone. A JSON report is written to stdout, and the exit code is 1 if any
+problems were found.
+`
+	fmt.Fprintf(os.Stderr, usage)
+	return nil
+}
+
+func verifyCommand(cmd *cobra.Command, args []string) {
+	var baseDir string
+	if len(args) > 0 {
+		baseDir = strings.TrimSpace(args[0])
+	}
+	if len(baseDir) == 0 {
+		os.Stderr.WriteString("Required: base directory")
+		cmd.Usage()
+		os.Exit(2)
+	}
+	stat, err := os.Stat(baseDir)
+	if err != nil || !stat.IsDir() {
+		os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", baseDir))
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	key, err := loadKey(verifyKeyFile)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	report, err := service.Verify(baseDir, key, verifyJobs)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to verify %q: %v\n", baseDir, err))
+		os.Exit(2)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
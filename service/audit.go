@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// AuditLogName is the file in the base directory of a folder store which
+// records every transfer to and from it
+const AuditLogName = "audit.log"
+
+// Outcomes of a transfer in the audit log
+const (
+	AuditOK     = "ok"
+	AuditFailed = "failed"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Repo      string    `json:"repo"`
+	Remote    string    `json:"remote,omitempty"`
+	Operation string    `json:"operation"`
+	Oid       string    `json:"oid"`
+	Size      int64     `json:"size"`
+	Outcome   string    `json:"outcome"`
+	// Code and Error are the transfer error if it failed
+	Code  int    `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditQuery selects entries from the audit log, blank fields matching
+// everything
+type AuditQuery struct {
+	Oid  string
+	User string
+	// Since and Until are the range of times to include, Until being
+	// exclusive
+	Since time.Time
+	Until time.Time
+}
+
+func (q *AuditQuery) matches(entry *AuditEntry) bool {
+	return (len(q.Oid) == 0 || entry.Oid == q.Oid) &&
+		(len(q.User) == 0 || entry.User == q.User) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// auditLog appends an entry to the audit log in a store for every transfer
+type auditLog struct {
+	path string
+	// Entries are written one at a time by this process, and other
+	// processes are kept out with a lock file
+	mu   sync.Mutex
+	user string
+	host string
+	repo string
+}
+
+// openAuditLog returns the audit log of the store at location, for transfers
+// from the repository in gitDir, or nil if the store isn't a folder
+func openAuditLog(location, gitDir string) (*auditLog, error) {
+	storage, err := backend.New(location)
+	if err != nil {
+		return nil, err
+	}
+	folder, ok := storage.(*backend.Folder)
+	if !ok {
+		return nil, nil
+	}
+	host, _ := os.Hostname()
+	repo := gitDir
+	if filepath.Base(gitDir) == ".git" {
+		repo = filepath.Dir(gitDir)
+	}
+	return &auditLog{
+		path: filepath.Join(folder.BaseDir, AuditLogName),
+		user: currentUser(),
+		host: host,
+		repo: repo,
+	}, nil
+}
+
+// currentUser returns the login name of whoever is running the adapter
+func currentUser() string {
+	if u, err := user.Current(); err == nil && len(u.Username) > 0 {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); len(name) > 0 {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// record appends the outcome of a transfer to the log
+func (a *auditLog) record(remote, operation, oid string, size int64, terr *api.TransferError) error {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		User:      a.user,
+		Host:      a.host,
+		Repo:      a.repo,
+		Remote:    remote,
+		Operation: operation,
+		Oid:       oid,
+		Size:      size,
+		Outcome:   AuditOK,
+	}
+	if terr != nil {
+		entry.Outcome = AuditFailed
+		entry.Code = terr.Code
+		entry.Error = terr.Message
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	unlock, err := backend.LockPath(a.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Each entry is a single append, so nothing is ever overwritten and a
+	// reader only ever sees whole lines, or a torn last line after a crash
+	f, err := os.OpenFile(a.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if stat, err := f.Stat(); err == nil && stat.Size() > 0 {
+		// Don't let a torn line swallow this one
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, stat.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// QueryAudit calls fn with every entry in the audit log of the store at
+// baseDir which matches q, oldest first. Lines which can't be read, e.g. one
+// torn by a crash, are skipped.
+func QueryAudit(baseDir string, q AuditQuery, fn func(entry *AuditEntry) error) error {
+	storage, err := backend.New(baseDir)
+	if err != nil {
+		return err
+	}
+	folder, ok := storage.(*backend.Folder)
+	if !ok {
+		return fmt.Errorf("%v does not have an audit log", baseDir)
+	}
+	f, err := os.Open(filepath.Join(folder.BaseDir, AuditLogName))
+	if os.IsNotExist(err) {
+		// Nothing audited yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !q.matches(&entry) {
+			continue
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
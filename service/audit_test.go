@@ -0,0 +1,99 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+
+	oids := []string{
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"1123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+
+	start := time.Now().Add(-time.Second)
+	// Several processes at once, each with a few transfers running
+	const writers = 4
+	const perWriter = 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		audit, err := openAuditLog(storepath, "/repo/.git")
+		assert.Nil(t, err)
+		if i == 0 {
+			audit.user = "alice"
+		}
+		for j := 0; j < perWriter; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				var terr *api.TransferError
+				if j == 0 {
+					terr = &api.TransferError{Code: 17, Message: "disk full"}
+				}
+				assert.Nil(t, audit.record("origin", "upload", oids[j%2], int64(j), terr))
+			}(j)
+		}
+	}
+	wg.Wait()
+
+	var all []*AuditEntry
+	err = QueryAudit(storepath, AuditQuery{}, func(entry *AuditEntry) error {
+		all = append(all, entry)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, writers*perWriter, len(all), "Every entry should be whole")
+	failed := 0
+	for _, entry := range all {
+		assert.Equal(t, "/repo", entry.Repo)
+		assert.Equal(t, "origin", entry.Remote)
+		assert.Equal(t, "upload", entry.Operation)
+		if entry.Outcome == AuditFailed {
+			failed++
+			assert.Equal(t, 17, entry.Code)
+		}
+	}
+	assert.Equal(t, writers, failed)
+
+	count := func(q AuditQuery) int {
+		n := 0
+		assert.Nil(t, QueryAudit(storepath, q, func(entry *AuditEntry) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+	assert.Equal(t, writers*12, count(AuditQuery{Oid: oids[1]}))
+	assert.Equal(t, perWriter, count(AuditQuery{User: "alice"}))
+	assert.Equal(t, 13, count(AuditQuery{User: "alice", Oid: oids[0]}))
+	assert.Equal(t, writers*perWriter, count(AuditQuery{Since: start, Until: time.Now().Add(time.Minute)}))
+	assert.Equal(t, 0, count(AuditQuery{Until: start}))
+	assert.Equal(t, 0, count(AuditQuery{Since: time.Now().Add(time.Minute)}))
+
+	// A line torn by a crash only loses that entry
+	logPath := filepath.Join(storepath, AuditLogName)
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	f.WriteString(`{"time":"2020-01-01T00:00:00Z","us`)
+	f.Close()
+	audit, err := openAuditLog(storepath, "/repo")
+	assert.Nil(t, err)
+	assert.Nil(t, audit.record("", "download", oids[0], 1, nil))
+	assert.Equal(t, writers*perWriter+1, count(AuditQuery{}))
+
+	// Not an object
+	report, err := Verify(storepath, nil, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+}
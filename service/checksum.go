@@ -0,0 +1,86 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// objectHash calculates the SHA-256 of the whole content of a stored object
+func objectHash(storage backend.Backend, oid string) (string, error) {
+	r, err := storage.Open(oid)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return readerHash(r)
+}
+
+func readerHash(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verifiedReader passes on the content of an object while hashing it. The
+// read which would finish the object fails instead if the content doesn't
+// match the oid, so whoever is reading never gets all of a corrupt object.
+type verifiedReader struct {
+	r         io.Reader
+	oid       string
+	remaining int64
+	hasher    hash.Hash
+}
+
+func newVerifiedReader(r io.Reader, oid string, size int64) *verifiedReader {
+	return &verifiedReader{r: r, oid: oid, remaining: size, hasher: sha256.New()}
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	v.remaining -= int64(n)
+	switch {
+	case v.remaining < 0:
+		return 0, &backend.CorruptObjectError{Oid: v.oid, Reason: "is longer than expected"}
+	case v.remaining > 0 && err == io.EOF:
+		return 0, &backend.CorruptObjectError{Oid: v.oid, Reason: "is truncated"}
+	case v.remaining == 0:
+		if hash := hex.EncodeToString(v.hasher.Sum(nil)); hash != v.oid {
+			return 0, &backend.CorruptObjectError{Oid: v.oid, Reason: fmt.Sprintf("has content with SHA-256 %v", hash)}
+		}
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+// storedObjectValid checks that the content of an existing object matches its
+// oid. If useCache is true and the backend supports it, objects which were
+// verified before and haven't changed since are trusted.
+func storedObjectValid(storage backend.Backend, oid string, useCache bool) (bool, error) {
+	cache, hasCache := storage.(backend.VerifiedCache)
+	useCache = useCache && hasCache
+	if useCache && cache.Verified(oid) {
+		return true, nil
+	}
+	hash, err := objectHash(storage, oid)
+	if err != nil {
+		return false, err
+	}
+	if hash != oid {
+		return false, nil
+	}
+	if useCache {
+		// Not fatal if this fails, it'll just be hashed again next time
+		cache.SetVerified(oid)
+	}
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// CleanupFile is a temp file or abandoned lock which cleanup found
+type CleanupFile struct {
+	Path string
+	Size int64
+	// Error is set if the file could not be removed
+	Error error
+}
+
+// CleanupReport is the result of cleaning up after interrupted transfers
+type CleanupReport struct {
+	Removed []CleanupFile
+	// InUse counts old temp files which were kept because an upload still
+	// holds the lock on their object
+	InUse        int
+	RemovedBytes int64
+}
+
+func (r *CleanupReport) remove(path string, size int64, dryRun bool) {
+	file := CleanupFile{Path: path, Size: size}
+	if !dryRun {
+		file.Error = os.Remove(path)
+	}
+	if file.Error == nil {
+		r.RemovedBytes += size
+	}
+	r.Removed = append(r.Removed, file)
+}
+
+// Cleanup removes temp files older than maxAge which were left behind by
+// interrupted transfers, both in a store and in the .git/lfs/tmp folders of
+// repositories which use it, along with abandoned locks. Temp files of objects
+// which are locked are kept, since an upload may still be using them. Stores
+// which aren't folders have nothing to clean up. With dryRun, the report is
+// produced without removing anything.
+func Cleanup(baseDir string, repos []string, maxAge time.Duration, dryRun bool) (*CleanupReport, error) {
+	report := &CleanupReport{}
+	if err := cleanupStore(baseDir, maxAge, dryRun, report); err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		gitDir, err := repoGitDir(repo)
+		if err != nil {
+			return nil, err
+		}
+		if err := cleanupDownloads(gitDir, maxAge, dryRun, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// cleanupStore removes old temp files and abandoned locks from a store
+func cleanupStore(location string, maxAge time.Duration, dryRun bool, report *CleanupReport) error {
+	storage, err := backend.New(location)
+	if err != nil {
+		return err
+	}
+	folder, ok := storage.(*backend.Folder)
+	if !ok {
+		return nil
+	}
+	cutoff := time.Now().Add(-maxAge)
+	return filepath.Walk(folder.BaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == folder.BaseDir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name := info.Name()
+		objectPath := ""
+		if len(name) > 64 && backend.ValidOid(name[:64]) {
+			objectPath = filepath.Join(filepath.Dir(path), name[:64])
+		}
+		switch {
+		case strings.HasSuffix(name, backend.LockSuffix):
+			if len(objectPath) > 0 && !backend.Locked(objectPath) {
+				report.remove(path, info.Size(), dryRun)
+			}
+		case strings.HasSuffix(name, ".tmp") && info.ModTime().Before(cutoff):
+			if len(objectPath) > 0 && backend.Locked(objectPath) {
+				report.InUse++
+			} else {
+				report.remove(path, info.Size(), dryRun)
+			}
+		}
+		return nil
+	})
+}
+
+// cleanupDownloads removes old partial downloads from a repository
+func cleanupDownloads(gitDir string, maxAge time.Duration, dryRun bool, report *CleanupReport) error {
+	dir := downloadTempDir(gitDir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, info := range entries {
+		// git-lfs keeps its own temp files here too, so only touch ours
+		name := info.Name()
+		if len(name) <= 64 || !backend.ValidOid(name[:64]) || !info.Mode().IsRegular() {
+			continue
+		}
+		if rest := name[64:]; rest != ".tmp" && rest != ".tmp.state" {
+			continue
+		}
+		if info.ModTime().Before(cutoff) {
+			report.remove(filepath.Join(dir, name), info.Size(), dryRun)
+		}
+	}
+	return nil
+}
+
+// sweep cleans up after interrupted transfers in the background when the
+// adapter starts, in every store which is written to and in the repository.
+// The returned channel is closed when it's finished.
+func sweep(opts Options, baseDir, gitDir string, log *util.Logger) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		report := &CleanupReport{}
+		for _, location := range append([]string{baseDir}, opts.Mirrors...) {
+			if err := cleanupStore(location, opts.CleanupAge, false, report); err != nil {
+				log.Warnf("Unable to clean up %q: %v", location, err)
+			}
+		}
+		if err := cleanupDownloads(gitDir, opts.CleanupAge, false, report); err != nil {
+			log.Warnf("Unable to clean up %q: %v", downloadTempDir(gitDir), err)
+		}
+		if len(report.Removed) > 0 {
+			log.Infof("Cleaned up %d temp files, %d bytes", len(report.Removed), report.RemovedBytes)
+		}
+	}()
+	return done
+}
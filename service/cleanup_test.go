@@ -0,0 +1,81 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanup(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+	repo, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-repo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(repo)
+	git(t, repo, "init", "-q")
+
+	oids := []string{
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"1123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"2123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(path string, size int, modTime time.Time) string {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, make([]byte, size), 0644))
+		assert.Nil(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+	objectPath := func(oid string) string {
+		return backend.StoragePath(storepath, oid)
+	}
+	gitDir, err := repoGitDir(repo)
+	assert.Nil(t, err)
+
+	// Old temp files of an object nobody is uploading, and an abandoned lock
+	stale := []string{
+		write(objectPath(oids[0])+".123.tmp", 100, old),
+		write(objectPath(oids[0])+".partial.tmp", 200, old),
+		write(objectPath(oids[0])+".state.tmp", 10, old),
+		write(objectPath(oids[0])+backend.LockSuffix, 0, old),
+		write(downloadTempPath(gitDir, oids[0]), 300, old),
+		write(downloadStatePath(downloadTempPath(gitDir, oids[0])), 20, old),
+	}
+	kept := []string{
+		// Too recent
+		write(objectPath(oids[1])+".456.tmp", 100, time.Now()),
+		write(downloadTempPath(gitDir, oids[1]), 100, time.Now()),
+		// Being uploaded
+		write(objectPath(oids[2])+".partial.tmp", 100, old),
+		write(objectPath(oids[2])+backend.LockSuffix, 0, time.Now()),
+		// Not ours
+		write(filepath.Join(downloadTempDir(gitDir), "something-else"), 100, old),
+	}
+
+	report, err := Cleanup(storepath, []string{repo}, 24*time.Hour, true)
+	assert.Nil(t, err)
+	assert.Equal(t, len(stale), len(report.Removed))
+	assert.Equal(t, int64(630), report.RemovedBytes)
+	assert.Equal(t, 1, report.InUse)
+	for _, path := range append(stale, kept...) {
+		assert.FileExists(t, path, "Dry run should not remove anything")
+	}
+
+	report, err = Cleanup(storepath, []string{repo}, 24*time.Hour, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(stale), len(report.Removed))
+	assert.Equal(t, int64(630), report.RemovedBytes)
+	for _, path := range stale {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "%v should be removed", path)
+	}
+	for _, path := range kept {
+		assert.FileExists(t, path)
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// objectFile returns the file behind a reader or writer, if there is one
+func objectFile(rw interface{}) *os.File {
+	switch f := rw.(type) {
+	case *os.File:
+		return f
+	case backend.FileWriter:
+		return f.File()
+	}
+	return nil
+}
+
+// fastCopy has the OS copy size bytes from src to dst, if they're both files
+// and the filesystem supports it. If it can't, nothing is copied and false is
+// returned so the caller can copy normally. Since the content never passes
+// through here, it's read back from dst to return its SHA-256.
+func fastCopy(size int64, src io.Reader, dst io.Writer, cb copyCallback) (string, bool, error) {
+	srcFile, dstFile := objectFile(src), objectFile(dst)
+	if srcFile == nil || dstFile == nil {
+		return "", false, nil
+	}
+	copied, err := copyFileFast(size, srcFile, dstFile, cb)
+	if !copied || err != nil {
+		return "", copied, err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(dstFile, 0, size)); err != nil {
+		return "", true, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), true, nil
+}
+
+// copyTransfer is copyResumable, but when fast is set and nothing has been
+// copied yet it tries fastCopy first
+func copyTransfer(size int64, src io.Reader, dst io.Writer, state *resumeState, checkpoint func(*resumeState) error, fast bool, cb copyCallback) (string, error) {
+	if fast && state.offset == 0 {
+		if hash, copied, err := fastCopy(size, src, dst, cb); copied || err != nil {
+			return hash, err
+		}
+	}
+	return copyResumable(size, src, dst, state, checkpoint, cb)
+}
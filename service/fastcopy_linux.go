@@ -0,0 +1,54 @@
+// +build linux
+
+package service
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileFast tries a reflink first, which shares the data between both files
+// until one of them changes, then copy_file_range, which copies within the
+// kernel. src and dst must both be at the start.
+func copyFileFast(size int64, src, dst *os.File, cb copyCallback) (bool, error) {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		if stat, err := dst.Stat(); err == nil && stat.Size() == size {
+			if cb != nil {
+				cb(size, size, int(size))
+			}
+			return true, nil
+		}
+		// Not what was asked for, so copy normally
+		if err := dst.Truncate(0); err != nil {
+			return true, err
+		}
+		return false, nil
+	}
+
+	const rangeSize int64 = 4 * 1024 * 1024
+	var copied int64
+	for copied < size {
+		next := rangeSize
+		if next > size-copied {
+			next = size - copied
+		}
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(next), 0)
+		if copied == 0 && (err != nil || n == 0) {
+			// Not supported here, and nothing has been copied yet
+			return false, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		if n == 0 {
+			return true, fmt.Errorf("unexpected end of data, %d of %d bytes read", copied, size)
+		}
+		copied += int64(n)
+		if cb != nil {
+			cb(size, copied, n)
+		}
+	}
+	return true, nil
+}
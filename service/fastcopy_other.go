@@ -0,0 +1,10 @@
+// +build !linux
+
+package service
+
+import "os"
+
+// copyFileFast is only supported on Linux
+func copyFileFast(size int64, src, dst *os.File, cb copyCallback) (bool, error) {
+	return false, nil
+}
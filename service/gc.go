@@ -0,0 +1,238 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// GCObject is an object which garbage collection found to be unreferenced
+type GCObject struct {
+	Oid  string
+	Size int64
+	// Error is set if the object could not be removed
+	Error error
+}
+
+// gcGracePeriod is how old an unreferenced object or unused chunk must be
+// before gc removes it. git-lfs uploads objects before pushing the commits
+// which refer to them, and chunks are stored before the manifest which uses
+// them, so a push which is still running leaves both behind for a while.
+var gcGracePeriod = time.Hour
+
+// GCReport is the result of garbage collecting a store
+type GCReport struct {
+	Objects      int
+	Referenced   int
+	Unreferenced []GCObject
+	// KeptObjects counts unreferenced objects which were kept because they
+	// are too recent, or because they are being uploaded
+	KeptObjects int
+	// Chunks counts the chunks of chunked objects, which are removed once no
+	// remaining object uses them
+	Chunks             int
+	UnreferencedChunks []GCObject
+	// KeptChunks counts unused chunks which were kept because they are too
+	// recent, or because an upload was running
+	KeptChunks   int
+	RemovedBytes int64
+}
+
+// GarbageCollect removes every object in a store which is not in the
+// referenced set, unless it is younger than gcGracePeriod or locked by an
+// upload which is still running. If trash is not nil, objects are moved there rather than
+// being deleted, chunked objects along with their chunks so the trash can be
+// read like any other store. With dryRun, the report is produced without
+// changing anything.
+func GarbageCollect(storage backend.Backend, referenced map[string]bool, trash backend.Backend, dryRun bool) (*GCReport, error) {
+	report := &GCReport{}
+
+	// Collect everything first, so we're not removing while listing
+	checker, _ := storage.(backend.LockChecker)
+	var unreferenced []*backend.ObjectInfo
+	cutoff := time.Now().Add(-gcGracePeriod)
+	err := storage.List(func(info *backend.ObjectInfo) error {
+		report.Objects++
+		if referenced[info.Oid] {
+			report.Referenced++
+		} else if info.ModTime.After(cutoff) || (checker != nil && checker.Locked(info.Oid)) {
+			report.KeptObjects++
+		} else {
+			unreferenced = append(unreferenced, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range unreferenced {
+		obj := GCObject{Oid: info.Oid, Size: info.Size}
+		if !dryRun {
+			if trash != nil {
+				obj.Error = trashChunks(storage, info.Oid, trash)
+			}
+			if obj.Error == nil {
+				obj.Error = removeObject(storage, info, trash)
+			}
+		}
+		if obj.Error == nil {
+			report.RemovedBytes += obj.Size
+		}
+		report.Unreferenced = append(report.Unreferenced, obj)
+	}
+
+	if err := collectChunks(storage, report, trash, dryRun); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// collectChunks removes chunks which aren't used by any object left in the
+// store, once unreferenced objects have been dealt with. Unused chunks are
+// only removed once they're older than gcGracePeriod, and not at all while an
+// upload is running, since it may be about to use them.
+func collectChunks(storage backend.Backend, report *GCReport, trash backend.Backend, dryRun bool) error {
+	ns, ok := storage.(backend.Namespaced)
+	if !ok {
+		return nil
+	}
+	chunks, err := ns.Namespace(backend.ChunksNamespace)
+	if err != nil {
+		return err
+	}
+	uploading := false
+	if checker, ok := storage.(backend.LockChecker); ok {
+		if uploading, err = checker.AnyLocked(); err != nil {
+			return err
+		}
+	}
+	removed := make(map[string]bool)
+	for _, obj := range report.Unreferenced {
+		if obj.Error == nil {
+			removed[obj.Oid] = true
+		}
+	}
+
+	// Manifests are never encrypted so we can read them here
+	used := make(map[string]bool)
+	err = storage.List(func(info *backend.ObjectInfo) error {
+		if removed[info.Oid] {
+			return nil
+		}
+		m, err := backend.OpenManifest(storage, info.Oid)
+		if err != nil {
+			// Can't tell which chunks it needs, so keep them all
+			return fmt.Errorf("Cannot read %v: %v", info.Oid, err)
+		}
+		if m != nil {
+			for _, c := range m.Chunks {
+				used[c.Hash] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var chunkTrash backend.Backend
+	if trashNs, ok := trash.(backend.Namespaced); ok {
+		if chunkTrash, err = trashNs.Namespace(backend.ChunksNamespace); err != nil {
+			return err
+		}
+	}
+	var unused []*backend.ObjectInfo
+	cutoff := time.Now().Add(-gcGracePeriod)
+	err = chunks.List(func(info *backend.ObjectInfo) error {
+		report.Chunks++
+		if used[info.Oid] {
+			return nil
+		}
+		if uploading || info.ModTime.After(cutoff) {
+			report.KeptChunks++
+			return nil
+		}
+		unused = append(unused, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, info := range unused {
+		chunk := GCObject{Oid: info.Oid, Size: info.Size}
+		if !dryRun {
+			chunk.Error = removeObject(chunks, info, chunkTrash)
+		}
+		if chunk.Error == nil {
+			report.RemovedBytes += chunk.Size
+		}
+		report.UnreferencedChunks = append(report.UnreferencedChunks, chunk)
+	}
+	return nil
+}
+
+// trashChunks copies the chunks of a chunked object to the trash, unless
+// they're there already, so that it can still be read from the trash once its
+// chunks have been removed from the store
+func trashChunks(storage backend.Backend, oid string, trash backend.Backend) error {
+	m, err := backend.OpenManifest(storage, oid)
+	if err != nil || m == nil {
+		return err
+	}
+	ns, ok := storage.(backend.Namespaced)
+	trashNs, trashOk := trash.(backend.Namespaced)
+	if !ok || !trashOk {
+		return fmt.Errorf("Cannot move chunks to trash, it has nowhere to keep them")
+	}
+	chunks, err := ns.Namespace(backend.ChunksNamespace)
+	if err != nil {
+		return err
+	}
+	chunkTrash, err := trashNs.Namespace(backend.ChunksNamespace)
+	if err != nil {
+		return err
+	}
+	for _, ref := range m.Chunks {
+		info, err := chunks.Stat(ref.Hash)
+		if err != nil {
+			return fmt.Errorf("Cannot move chunk %v to trash: %v", ref.Hash, err)
+		}
+		if trashed, err := chunkTrash.Stat(ref.Hash); err == nil && trashed.Size == info.Size {
+			continue
+		}
+		if err := copyObject(chunks, chunkTrash, ref.Hash, info.Size); err != nil {
+			return fmt.Errorf("Cannot move chunk %v to trash: %v", ref.Hash, err)
+		}
+	}
+	return nil
+}
+
+func removeObject(storage backend.Backend, info *backend.ObjectInfo, trash backend.Backend) error {
+	if trash != nil {
+		if err := copyObject(storage, trash, info.Oid, info.Size); err != nil {
+			return fmt.Errorf("Cannot move to trash: %v", err)
+		}
+	}
+	return storage.Delete(info.Oid)
+}
+
+// copyObject copies an object from one store to another
+func copyObject(from, to backend.Backend, oid string, size int64) error {
+	r, err := from.Open(oid)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := to.Create(oid, size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
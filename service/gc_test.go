@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func git(t *testing.T, dir string, args ...string) {
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)
+	cmd := util.NewCmd("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, "git %v: %v", args, string(out))
+}
+
+func writePointer(t *testing.T, path string, file testFile) {
+	pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%v\nsize %d\n", file.oid, file.size)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(pointer), 0644))
+}
+
+func TestGarbageCollect(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Put everything in the store
+	Serve(Config{BaseDir: setup.remotepath}, setup.inputBuffer, ioutil.Discard, ioutil.Discard)
+
+	// Repo refers to file 1 in history and file 2 at the tip, never file 3
+	repo, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-repo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(repo)
+	git(t, repo, "init", "-q")
+	writePointer(t, filepath.Join(repo, "asset.bin"), setup.files[0])
+	git(t, repo, "add", "asset.bin")
+	git(t, repo, "commit", "-q", "-m", "first")
+	writePointer(t, filepath.Join(repo, "asset.bin"), setup.files[1])
+	git(t, repo, "commit", "-q", "-a", "-m", "second")
+
+	referenced, err := ReferencedOids(repo, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{setup.files[0].oid: true, setup.files[1].oid: true}, referenced)
+
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+	defer func(grace time.Duration) { gcGracePeriod = grace }(gcGracePeriod)
+	gcGracePeriod = 0
+
+	// Dry run changes nothing
+	report, err := GarbageCollect(storage, referenced, nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Objects)
+	assert.Equal(t, 2, report.Referenced)
+	assert.Equal(t, 1, len(report.Unreferenced))
+	assert.Equal(t, setup.files[2].oid, report.Unreferenced[0].Oid)
+	assert.Equal(t, setup.files[2].size, report.RemovedBytes)
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[2].oid))
+
+	trash, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-trash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(trash)
+	trashStorage, err := backend.NewFolder(trash)
+	assert.Nil(t, err)
+	report, err = GarbageCollect(storage, referenced, trashStorage, false)
+	assert.Nil(t, err)
+	assert.Nil(t, report.Unreferenced[0].Error)
+	_, err = os.Stat(backend.StoragePath(setup.remotepath, setup.files[2].oid))
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, backend.StoragePath(trash, setup.files[2].oid))
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[0].oid))
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[1].oid))
+}
+
+func TestGarbageCollectRecentObjects(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	Serve(Config{BaseDir: setup.remotepath}, setup.inputBuffer, ioutil.Discard, ioutil.Discard)
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+	defer func(grace time.Duration) { gcGracePeriod = grace }(gcGracePeriod)
+
+	// Objects which were just uploaded may belong to a push which hasn't
+	// updated any refs yet
+	referenced := map[string]bool{setup.files[0].oid: true, setup.files[1].oid: true}
+	report, err := GarbageCollect(storage, referenced, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.KeptObjects)
+	assert.Empty(t, report.Unreferenced)
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[2].oid))
+
+	// and so may old ones which are being uploaded again
+	gcGracePeriod = 0
+	unlock, err := backend.Lock(storage, setup.files[2].oid)
+	assert.Nil(t, err)
+	report, err = GarbageCollect(storage, referenced, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.KeptObjects)
+	assert.Empty(t, report.Unreferenced)
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[2].oid))
+
+	unlock()
+	report, err = GarbageCollect(storage, referenced, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.KeptObjects)
+	assert.Equal(t, 1, len(report.Unreferenced))
+	_, err = os.Stat(backend.StoragePath(setup.remotepath, setup.files[2].oid))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGarbageCollectChunksDuringUpload(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+	storage, err := backend.NewFolder(storepath)
+	assert.Nil(t, err)
+	chunkStore, err := storage.Namespace(backend.ChunksNamespace)
+	assert.Nil(t, err)
+	chunked := backend.NewChunked(storage, storage, chunkStore, true)
+	defer func(grace time.Duration) { gcGracePeriod = grace }(gcGracePeriod)
+
+	data := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+
+	// Chunks are stored while the upload runs, before anything refers to them
+	unlock, err := backend.Lock(chunked, oid)
+	assert.Nil(t, err)
+	w, err := chunked.Create(oid, int64(len(data)))
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+
+	// Recent chunks are kept
+	report, err := GarbageCollect(storage, map[string]bool{}, nil, false)
+	assert.Nil(t, err)
+	assert.True(t, report.KeptChunks > 0)
+	assert.Empty(t, report.UnreferencedChunks)
+	// and so are old ones while something is being uploaded
+	gcGracePeriod = 0
+	report, err = GarbageCollect(storage, map[string]bool{}, nil, false)
+	assert.Nil(t, err)
+	assert.True(t, report.KeptChunks > 0)
+	assert.Empty(t, report.UnreferencedChunks)
+
+	assert.Nil(t, w.Commit())
+	unlock()
+	r, err := chunked.Open(oid)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+
+	// Once nothing is uploading, chunks nothing uses can go, including those
+	// of an upload which was abandoned
+	w, err = chunked.Create(oid, int64(len(data)))
+	assert.Nil(t, err)
+	other := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(other)
+	_, err = w.Write(other)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Abort())
+	assert.Nil(t, chunked.Delete(oid))
+	report, err = GarbageCollect(storage, map[string]bool{}, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.KeptChunks)
+	assert.True(t, len(report.UnreferencedChunks) > 0)
+
+	// An upload which reuses chunks gc has just removed fails instead of
+	// committing an object which can't be read
+	first, err := chunked.Create(oid, int64(len(data)))
+	assert.Nil(t, err)
+	_, err = first.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, first.Commit())
+	w, err = chunked.Create(oid, int64(len(data)))
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, chunked.Delete(oid))
+	_, err = GarbageCollect(storage, map[string]bool{}, nil, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, w.Commit())
+	_, err = chunked.Stat(oid)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGarbageCollectChunkedTrash(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+	trashpath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-trash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(trashpath)
+	defer func(grace time.Duration) { gcGracePeriod = grace }(gcGracePeriod)
+	gcGracePeriod = 0
+
+	chunked, err := OpenStore(storepath, Options{Chunk: true})
+	assert.Nil(t, err)
+	// Two versions sharing most of their chunks
+	v1 := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(v1)
+	v2 := append(append([]byte(nil), v1...), []byte("more")...)
+	var oids []string
+	for _, data := range [][]byte{v1, v2} {
+		sum := sha256.Sum256(data)
+		oid := hex.EncodeToString(sum[:])
+		assert.Nil(t, writeObject(chunked, oid, int64(len(data)), bytes.NewReader(data)))
+		oids = append(oids, oid)
+	}
+
+	storage, err := backend.NewFolder(storepath)
+	assert.Nil(t, err)
+	trash, err := backend.NewFolder(trashpath)
+	assert.Nil(t, err)
+	// Most of v1's chunks are still used by v2, but go to the trash with it
+	report, err := GarbageCollect(storage, map[string]bool{oids[1]: true}, trash, false)
+	assert.Nil(t, err)
+	assert.Len(t, report.Unreferenced, 1)
+	assert.Nil(t, report.Unreferenced[0].Error)
+	// and stay there once v2 and its chunks are gone
+	report, err = GarbageCollect(storage, map[string]bool{}, nil, false)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, report.UnreferencedChunks)
+
+	// so it can still be read from there
+	fromTrash, err := OpenStore(trashpath, Options{})
+	assert.Nil(t, err)
+	r, err := fromTrash.Open(oids[0])
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, v1, content)
+	valid, err := storedObjectValid(fromTrash, oids[0], false)
+	assert.Nil(t, err)
+	assert.True(t, valid)
+}
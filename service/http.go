@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// Media type of all LFS API requests and responses
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+type batchObject struct {
+	Oid           string                  `json:"oid"`
+	Size          int64                   `json:"size"`
+	Authenticated bool                    `json:"authenticated,omitempty"`
+	Actions       map[string]*batchAction `json:"actions,omitempty"`
+	Error         *batchError             `json:"error,omitempty"`
+}
+
+type batchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type batchError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchRequest struct {
+	Operation string         `json:"operation"`
+	Transfers []string       `json:"transfers,omitempty"`
+	Objects   []*batchObject `json:"objects"`
+	HashAlgo  string         `json:"hash_algo,omitempty"`
+}
+
+type batchResponse struct {
+	Transfer string         `json:"transfer"`
+	Objects  []*batchObject `json:"objects"`
+	HashAlgo string         `json:"hash_algo,omitempty"`
+}
+
+// HTTPHandler serves the git-lfs HTTP API (batch API and basic transfers)
+// from a store. Requests are accepted under any path prefix, so
+// that both the server root and <repo>/info/lfs can be used as the LFS URL.
+// There is no authentication, that's left to a proxy in front of it.
+func HTTPHandler(storage backend.Backend) http.Handler {
+	return &httpHandler{storage: storage}
+}
+
+type httpHandler struct {
+	storage backend.Backend
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idx := strings.LastIndex(r.URL.Path, "/objects/")
+	if idx < 0 {
+		writeHTTPError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	prefix := r.URL.Path[:idx]
+	rest := strings.Split(r.URL.Path[idx+len("/objects/"):], "/")
+
+	switch {
+	case len(rest) == 1 && rest[0] == "batch" && r.Method == http.MethodPost:
+		h.batch(w, r, prefix)
+	case len(rest) == 1 && backend.ValidOid(rest[0]) && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		h.download(w, r, rest[0])
+	case len(rest) == 1 && backend.ValidOid(rest[0]) && r.Method == http.MethodPut:
+		h.upload(w, r, rest[0])
+	case len(rest) == 2 && backend.ValidOid(rest[0]) && rest[1] == "verify" && r.Method == http.MethodPost:
+		h.verify(w, r, rest[0])
+	default:
+		writeHTTPError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&batchError{Code: status, Message: message})
+}
+
+func (h *httpHandler) batch(w http.ResponseWriter, r *http.Request, prefix string) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("Invalid batch request: %v", err))
+		return
+	}
+	if len(req.HashAlgo) > 0 && req.HashAlgo != "sha256" {
+		writeHTTPError(w, http.StatusConflict, fmt.Sprintf("Unsupported hash algorithm %q", req.HashAlgo))
+		return
+	}
+	if req.Operation != "upload" && req.Operation != "download" {
+		writeHTTPError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unsupported operation %q", req.Operation))
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	objectsURL := fmt.Sprintf("%v://%v%v/objects/", scheme, r.Host, prefix)
+
+	resp := &batchResponse{Transfer: "basic", HashAlgo: "sha256"}
+	for _, obj := range req.Objects {
+		out := &batchObject{Oid: obj.Oid, Size: obj.Size, Authenticated: true}
+		resp.Objects = append(resp.Objects, out)
+
+		if !backend.ValidOid(obj.Oid) || obj.Size < 0 {
+			out.Error = &batchError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			continue
+		}
+		info, err := h.storage.Stat(obj.Oid)
+		exists := err == nil && info.Size == obj.Size
+
+		href := objectsURL + obj.Oid
+		if req.Operation == "download" {
+			if !exists {
+				out.Error = &batchError{Code: http.StatusNotFound, Message: "Object does not exist"}
+				continue
+			}
+			out.Actions = map[string]*batchAction{"download": {Href: href}}
+		} else if !exists {
+			// No actions means the client doesn't need to upload
+			out.Actions = map[string]*batchAction{
+				"upload": {Href: href},
+				"verify": {Href: href + "/verify"},
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *httpHandler) download(w http.ResponseWriter, r *http.Request, oid string) {
+	info, err := h.storage.Stat(oid)
+	if err != nil {
+		writeHTTPError(w, http.StatusNotFound, "Object does not exist")
+		return
+	}
+	f, err := h.storage.Open(oid)
+	if err != nil {
+		writeHTTPError(w, http.StatusNotFound, "Object does not exist")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, newVerifiedReader(f, oid, info.Size)); err != nil {
+		// Too late for an error status, so drop the connection before the
+		// client has everything it was promised
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (h *httpHandler) upload(w http.ResponseWriter, r *http.Request, oid string) {
+	// Like the transfer adapter, only one upload of an object at a time
+	unlock, err := backend.Lock(h.storage, oid)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer unlock()
+	err = writeObject(h.storage, oid, r.ContentLength, r.Body)
+	if _, ok := err.(*contentMismatchError); ok {
+		writeHTTPError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	} else if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *httpHandler) verify(w http.ResponseWriter, r *http.Request, oid string) {
+	var obj batchObject
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("Invalid verify request: %v", err))
+		return
+	}
+	info, err := h.storage.Stat(oid)
+	if err != nil {
+		writeHTTPError(w, http.StatusNotFound, "Object does not exist")
+		return
+	}
+	if info.Size != obj.Size {
+		writeHTTPError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Object is %d bytes, expected %d", info.Size, obj.Size))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
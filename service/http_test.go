@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(t *testing.T, url string, req *batchRequest) *batchResponse {
+	b, err := json.Marshal(req)
+	assert.Nil(t, err)
+	resp, err := http.Post(url+"/info/lfs/objects/batch", lfsMediaType, bytes.NewReader(b))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var batch batchResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&batch))
+	return &batch
+}
+
+func TestHTTPHandler(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+	server := httptest.NewServer(HTTPHandler(storage))
+	defer server.Close()
+
+	file := setup.files[2]
+	content, err := ioutil.ReadFile(file.path)
+	assert.Nil(t, err)
+
+	// Nothing to download yet
+	batch := postBatch(t, server.URL, &batchRequest{Operation: "download", Objects: []*batchObject{{Oid: file.oid, Size: file.size}}})
+	assert.Equal(t, http.StatusNotFound, batch.Objects[0].Error.Code)
+
+	// Upload it
+	batch = postBatch(t, server.URL, &batchRequest{Operation: "upload", Objects: []*batchObject{{Oid: file.oid, Size: file.size}}})
+	assert.Equal(t, "basic", batch.Transfer)
+	upload := batch.Objects[0].Actions["upload"]
+	verify := batch.Objects[0].Actions["verify"]
+	assert.Equal(t, server.URL+"/info/lfs/objects/"+file.oid, upload.Href)
+
+	// Bad content is rejected
+	req, _ := http.NewRequest(http.MethodPut, upload.Href, bytes.NewReader(content[1:]))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodPut, upload.Href, bytes.NewReader(content))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, file.oid)))
+
+	b, _ := json.Marshal(&batchObject{Oid: file.oid, Size: file.size})
+	resp, err = http.Post(verify.Href, lfsMediaType, bytes.NewReader(b))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Already stored, so nothing more to upload
+	batch = postBatch(t, server.URL, &batchRequest{Operation: "upload", Objects: []*batchObject{{Oid: file.oid, Size: file.size}}})
+	assert.Nil(t, batch.Objects[0].Actions)
+
+	// And download it again
+	batch = postBatch(t, server.URL, &batchRequest{Operation: "download", Objects: []*batchObject{{Oid: file.oid, Size: file.size}}})
+	resp, err = http.Get(batch.Objects[0].Actions["download"].Href)
+	assert.Nil(t, err)
+	downloaded, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, content, downloaded)
+
+	// A corrupt object is never delivered whole
+	corrupt := append([]byte(nil), content...)
+	corrupt[len(corrupt)-1] ^= 1
+	assert.Nil(t, ioutil.WriteFile(backend.StoragePath(setup.remotepath, file.oid), corrupt, 0644))
+	resp, err = http.Get(batch.Objects[0].Actions["download"].Href)
+	assert.Nil(t, err)
+	downloaded, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NotNil(t, err)
+	assert.True(t, len(downloaded) < len(content))
+}
+
+func TestHTTPUploadLocked(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+	server := httptest.NewServer(HTTPHandler(storage))
+	defer server.Close()
+	file := setup.files[0]
+	content, err := ioutil.ReadFile(file.path)
+	assert.Nil(t, err)
+
+	// An upload waits while another process is writing the same object
+	unlock, err := backend.Lock(storage, file.oid)
+	assert.Nil(t, err)
+	done := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/objects/"+file.oid, bytes.NewReader(content))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case <-done:
+		t.Fatal("Upload should wait for the lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+	_, err = os.Stat(backend.StoragePath(setup.remotepath, file.oid))
+	assert.True(t, os.IsNotExist(err))
+
+	unlock()
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, file.oid)))
+	_, err = os.Stat(backend.StoragePath(setup.remotepath, file.oid) + backend.LockSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter holds transfers to a number of bytes per second between them,
+// however many are running at once
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// next is when everything allowed through so far will have been due
+	next time.Time
+	// now and sleep are the clock, which tests replace
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newRateLimiter returns a limiter for bytesPerSec, or nil if it's 0, which
+// means no limit
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: bytesPerSec, now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until n more bytes can be transferred
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	l.sleep(delay)
+}
+
+// limitReader slows down reads from r to what l allows, if l isn't nil
+func limitReader(r io.Reader, l *rateLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0), "0 means no limit")
+
+	// Two transfers at once share the limit, so between them they take as
+	// long as one twice the size
+	const size = 4 * 1024 * 16 * 4
+	limiter := newRateLimiter(size * 4)
+	// Time stands still, so each wait is for everything let through so far
+	start := time.Now()
+	var mu sync.Mutex
+	var longest time.Duration
+	limiter.now = func() time.Time { return start }
+	limiter.sleep = func(d time.Duration) {
+		mu.Lock()
+		if d > longest {
+			longest = d
+		}
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last int64
+			var total int64
+			_, err := copyFileContents(size, limitReader(bytes.NewReader(make([]byte, size)), limiter), ioutil.Discard, func(totalSize, readSoFar int64, readSinceLast int) error {
+				last = readSoFar
+				total += int64(readSinceLast)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, int64(size), last, "Progress should still reach the end")
+			assert.Equal(t, int64(size), total)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 500*time.Millisecond, longest)
+}
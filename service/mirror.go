@@ -0,0 +1,74 @@
+package service
+
+import (
+	"sort"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// MirrorStatus describes what one store is missing compared with the others
+type MirrorStatus struct {
+	Location string   `json:"location"`
+	Objects  int      `json:"objects"`
+	Missing  []string `json:"missing"`
+	// Error is set if the store could not be read at all
+	Error string `json:"error,omitempty"`
+}
+
+// MirrorReport is the result of comparing a set of mirrored stores
+type MirrorReport struct {
+	// Objects is how many distinct objects are in any of the stores
+	Objects int            `json:"objects"`
+	Mirrors []MirrorStatus `json:"mirrors"`
+}
+
+// OK returns whether every store has every object
+func (r *MirrorReport) OK() bool {
+	for _, m := range r.Mirrors {
+		if len(m.Missing) > 0 || len(m.Error) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareMirrors lists every store and reports which objects each one is
+// missing that another one has, i.e. which mirrors are lagging
+func CompareMirrors(locations []string) *MirrorReport {
+	report := &MirrorReport{}
+	all := make(map[string]bool)
+	contents := make([]map[string]bool, len(locations))
+	for i, location := range locations {
+		report.Mirrors = append(report.Mirrors, MirrorStatus{Location: location, Missing: []string{}})
+		status := &report.Mirrors[i]
+		storage, err := backend.New(location)
+		if err == nil {
+			contents[i] = make(map[string]bool)
+			err = storage.List(func(info *backend.ObjectInfo) error {
+				contents[i][info.Oid] = true
+				all[info.Oid] = true
+				return nil
+			})
+		}
+		if err != nil {
+			status.Error = err.Error()
+			contents[i] = nil
+			continue
+		}
+		status.Objects = len(contents[i])
+	}
+
+	report.Objects = len(all)
+	for i := range report.Mirrors {
+		if contents[i] == nil {
+			continue
+		}
+		for oid := range all {
+			if !contents[i][oid] {
+				report.Mirrors[i].Missing = append(report.Mirrors[i].Missing, oid)
+			}
+		}
+		sort.Strings(report.Mirrors[i].Missing)
+	}
+	return report
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// contentMismatchError is returned when data doesn't hash to its oid
+type contentMismatchError struct {
+	hash string
+}
+
+func (e *contentMismatchError) Error() string {
+	return fmt.Sprintf("Content has SHA-256 %v, does not match oid", e.hash)
+}
+
+// writeObject stores everything read from r as the object oid, which is size
+// bytes or -1 if unknown. Nothing is committed to the store unless the content
+// is verified against the oid.
+func writeObject(storage backend.Backend, oid string, size int64, r io.Reader) error {
+	w, err := storage.Create(oid, size)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hasher), r); err != nil {
+		w.Abort()
+		return fmt.Errorf("Error writing %v: %v", oid, err)
+	}
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != oid {
+		w.Abort()
+		return &contentMismatchError{hash}
+	}
+	return w.Commit()
+}
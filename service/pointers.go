@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// LFS pointer files are always small, same limit as git-lfs uses
+const maxPointerSize = 1024
+
+// ReferencedOids finds the oid of every LFS object which is referenced from the
+// given refs of a git repository, in any commit reachable from them. If since
+// is not blank, only commits since that date (in any format git accepts) are
+// considered, although the commits the refs point at are always included.
+// A blank list of refs means all refs.
+func ReferencedOids(repoDir string, refs []string, since string) (map[string]bool, error) {
+	revArgs := refs
+	if len(revArgs) == 0 {
+		revArgs = []string{"--all"}
+	}
+
+	var revLists [][]string
+	if len(since) > 0 {
+		revLists = append(revLists, append([]string{"--since=" + since}, revArgs...))
+		revLists = append(revLists, append([]string{"--no-walk"}, revArgs...))
+	} else {
+		revLists = append(revLists, revArgs)
+	}
+
+	blobs := make(map[string]bool)
+	for _, extra := range revLists {
+		args := append([]string{"rev-list", "--objects"}, extra...)
+		cmd := util.NewCmd("git", args...)
+		cmd.Dir = repoDir
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to call git rev-list in %q: %v", repoDir, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 0 {
+				blobs[fields[0]] = true
+			}
+		}
+	}
+
+	// Only read the content of objects which could be pointers
+	var query bytes.Buffer
+	for sha := range blobs {
+		query.WriteString(sha + "\n")
+	}
+	cmd := util.NewCmd("git", "cat-file", "--batch-check")
+	cmd.Dir = repoDir
+	cmd.Stdin = &query
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call git cat-file in %q: %v", repoDir, err)
+	}
+	var candidates bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// <sha> <type> <size>
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err == nil && size < maxPointerSize {
+			candidates.WriteString(fields[0] + "\n")
+		}
+	}
+
+	cmd = util.NewCmd("git", "cat-file", "--batch")
+	cmd.Dir = repoDir
+	cmd.Stdin = &candidates
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call git cat-file in %q: %v", repoDir, err)
+	}
+
+	oids := make(map[string]bool)
+	r := bufio.NewReader(bytes.NewReader(out))
+	for {
+		header, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Unexpected output from git cat-file: %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected output from git cat-file: %q", header)
+		}
+		// content is followed by a newline
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		if oid := pointerOid(content[:size]); len(oid) > 0 {
+			oids[oid] = true
+		}
+	}
+	return oids, nil
+}
+
+// pointerOid returns the oid from the content of an LFS pointer file, or
+// blank if it's not a pointer
+func pointerOid(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("version https://git-lfs")) {
+		return ""
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "oid sha256:") {
+			oid := strings.TrimPrefix(line, "oid sha256:")
+			if backend.ValidOid(oid) {
+				return oid
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+// sharedOutput is a stream which is written to by multiple transfers at once
+type sharedOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newWriter returns a buffered writer for use by a single goroutine. Output is
+// only passed on to the shared stream a whole line at a time, so messages from
+// concurrent transfers can never be interleaved mid-line
+func (o *sharedOutput) newWriter() *bufio.Writer {
+	return bufio.NewWriter(&lineWriter{out: o})
+}
+
+// lineWriter holds back partial lines until they are terminated
+type lineWriter struct {
+	out     *sharedOutput
+	pending []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.pending = append(l.pending, p...)
+	end := bytes.LastIndexByte(l.pending, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	l.out.mu.Lock()
+	_, err := l.out.w.Write(l.pending[:end+1])
+	l.out.mu.Unlock()
+	l.pending = append(l.pending[:0], l.pending[end+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type transferFunc func(req *api.Request, writer *bufio.Writer)
+
+// transferPool runs transfers on a fixed number of worker goroutines
+type transferPool struct {
+	requests chan *api.Request
+	wg       sync.WaitGroup
+}
+
+func newTransferPool(workers int, out *sharedOutput, fn transferFunc) *transferPool {
+	p := &transferPool{
+		// Buffer enough that reading stdin isn't held up by busy workers
+		requests: make(chan *api.Request, workers*2),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			writer := out.newWriter()
+			for req := range p.requests {
+				fn(req, writer)
+			}
+		}()
+	}
+	return p
+}
+
+func (p *transferPool) submit(req *api.Request) {
+	p.requests <- req
+}
+
+// wait stops accepting requests and blocks until all submitted ones are done
+func (p *transferPool) wait() {
+	close(p.requests)
+	p.wg.Wait()
+}
+
+// workerCount determines how many transfers to run at once from the init event
+func workerCount(req *api.Request) int {
+	if !req.Concurrent || req.ConcurrentTransfers < 1 {
+		return 1
+	}
+	return req.ConcurrentTransfers
+}
@@ -0,0 +1,35 @@
+package service
+
+import "time"
+
+// Progress events for a transfer are sent at most every progressInterval, or
+// whenever another progressStep percent has been transferred, whichever comes
+// first. Each block copied is 64KB, so sending an event for every one would
+// mean tens of thousands of them for a large object.
+var (
+	progressInterval       = 200 * time.Millisecond
+	progressStep     int64 = 10
+	// progressClock tells the time for throttling, so tests can control it
+	progressClock = time.Now
+)
+
+// throttleProgress wraps cb so that progress is coalesced into fewer calls.
+// The first and last calls are always passed on, so lfs knows a transfer has
+// started and always sees it reach 100%.
+func throttleProgress(cb copyCallback) copyCallback {
+	var last time.Time
+	var reported int64
+	return func(totalSize, readSoFar int64, readSinceLast int) error {
+		now := progressClock()
+		if readSoFar < totalSize && !last.IsZero() && now.Sub(last) < progressInterval {
+			step := totalSize * progressStep / 100
+			if step == 0 || readSoFar/step == reported/step {
+				return nil
+			}
+		}
+		last = now
+		sinceLast := readSoFar - reported
+		reported = readSoFar
+		return cb(totalSize, readSoFar, int(sinceLast))
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleProgress(t *testing.T) {
+	const size = 4 * 1024 * 16 * 1000
+	defer func(clock func() time.Time) { progressClock = clock }(progressClock)
+	now := time.Now()
+	progressClock = func() time.Time { return now }
+	var events []int64
+	var total int64
+	cb := throttleProgress(func(totalSize, readSoFar int64, readSinceLast int) error {
+		events = append(events, readSoFar)
+		total += int64(readSinceLast)
+		return nil
+	})
+	hash, err := copyFileContents(size, bytes.NewReader(make([]byte, size)), ioutil.Discard, cb)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, hash)
+
+	// However quick the copy, there's the first event and one per 10%
+	assert.Equal(t, 11, len(events))
+	assert.Equal(t, int64(size), events[len(events)-1], "Last event must be 100%")
+	assert.Equal(t, int64(size), total, "Coalesced events must add up to the whole object")
+
+	// and however slow, time alone is enough to send an event
+	progressClock = func() time.Time {
+		now = now.Add(progressInterval)
+		return now
+	}
+	events = nil
+	_, err = copyFileContents(size, bytes.NewReader(make([]byte, size)), ioutil.Discard, throttleProgress(func(totalSize, readSoFar int64, readSinceLast int) error {
+		events = append(events, readSoFar)
+		return nil
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(events))
+}
+
+// benchmarkProgress copies an object sending progress to lfs the way a
+// transfer does
+func benchmarkProgress(b *testing.B, throttle bool) {
+	const size = 256 * 1024 * 1024
+	data := make([]byte, size)
+	writer := bufio.NewWriter(ioutil.Discard)
+	log := util.NewLogger(ioutil.Discard, util.LogInfo, false)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var cb copyCallback = func(totalSize, readSoFar int64, readSinceLast int) error {
+			api.SendProgress("oid", readSoFar, readSinceLast, writer, log)
+			return nil
+		}
+		if throttle {
+			cb = throttleProgress(cb)
+		}
+		if _, err := copyFileContents(size, bytes.NewReader(data), ioutil.Discard, cb); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgressEveryBlock(b *testing.B) {
+	benchmarkProgress(b, false)
+}
+
+func BenchmarkProgressThrottled(b *testing.B) {
+	benchmarkProgress(b, true)
+}
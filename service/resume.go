@@ -0,0 +1,144 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// checkpointInterval is how often a transfer records how far it has got, so
+// only objects bigger than this can be resumed
+var checkpointInterval int64 = 64 * 1024 * 1024
+
+// resumeState is how far a transfer got, with the hash of everything up to
+// there so the full digest can still be checked without reading it again
+type resumeState struct {
+	offset int64
+	hasher hash.Hash
+}
+
+func newResumeState() *resumeState {
+	return &resumeState{hasher: sha256.New()}
+}
+
+// encode saves the state as offset (8) | size (8) | hash state
+func (s *resumeState) encode(size int64) ([]byte, error) {
+	hashState, err := s.hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 16, 16+len(hashState))
+	binary.BigEndian.PutUint64(data, uint64(s.offset))
+	binary.BigEndian.PutUint64(data[8:], uint64(size))
+	return append(data, hashState...), nil
+}
+
+// decodeResumeState restores a state saved for an object of the given size.
+// Anything which doesn't match just means starting again.
+func decodeResumeState(data []byte, size int64) *resumeState {
+	s := newResumeState()
+	if len(data) < 16 || int64(binary.BigEndian.Uint64(data[8:])) != size {
+		return s
+	}
+	offset := int64(binary.BigEndian.Uint64(data))
+	if offset < 0 || offset > size {
+		return s
+	}
+	if err := s.hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(data[16:]); err != nil {
+		return newResumeState()
+	}
+	s.offset = offset
+	return s
+}
+
+// skipTo moves a source on to offset, seeking if it can
+func skipTo(r io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	n, err := io.CopyN(ioutil.Discard, r, offset)
+	if err == io.EOF {
+		return fmt.Errorf("unexpected end of data, %d of %d bytes read", n, offset)
+	}
+	return err
+}
+
+func downloadStatePath(dlfilename string) string {
+	return dlfilename + ".state"
+}
+
+// openPartialDownload opens the temp file for a download, keeping whatever an
+// interrupted attempt checkpointed, and returns where to carry on from
+func openPartialDownload(dlfilename string, size int64) (*os.File, *resumeState, error) {
+	// No state just means starting again
+	data, _ := ioutil.ReadFile(downloadStatePath(dlfilename))
+	state := decodeResumeState(data, size)
+	f, err := os.OpenFile(dlfilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat, err := f.Stat(); err != nil || stat.Size() < state.offset {
+		state = newResumeState()
+	}
+	if err := f.Truncate(state.offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(state.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, state, nil
+}
+
+// checkpointDownload records how far a download has got
+func checkpointDownload(f *os.File, dlfilename string, size int64, state *resumeState) error {
+	// State must never claim more than is really on disk
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	data, err := state.encode(size)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(downloadStatePath(dlfilename), data, 0644)
+}
+
+// removePartialDownload throws away a download so the next attempt starts again
+func removePartialDownload(dlfilename string) {
+	os.Remove(dlfilename)
+	os.Remove(downloadStatePath(dlfilename))
+}
+
+// createResumable starts writing an object to a store, carrying on from an
+// interrupted upload if there is one. It returns ErrNotResumable if the object
+// is too small to be worth it or the store can't do it.
+func createResumable(storage backend.Backend, oid string, size int64) (backend.ResumableWriter, *resumeState, error) {
+	if size <= checkpointInterval {
+		return nil, nil, backend.ErrNotResumable
+	}
+	w, data, err := backend.CreateResumable(storage, oid, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := decodeResumeState(data, size)
+	if err := w.Resume(state.offset); err != nil {
+		state = newResumeState()
+		if err := w.Resume(0); err != nil {
+			w.Abort()
+			return nil, nil, err
+		}
+	}
+	return w, state, nil
+}
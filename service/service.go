@@ -2,260 +2,661 @@ package service
 
 import (
 	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/backend"
 	"github.com/sinbad/lfs-folderstore/util"
 )
 
+// Options controls optional behaviour of the protocol server
+type Options struct {
+	// ChecksumCache records the hash of verified objects in a sidecar file, so
+	// unchanged objects aren't hashed again every time they're uploaded
+	ChecksumCache bool
+	// Compress writes new objects compressed with zstd. Compressed objects are
+	// always read back transparently, whether or not this is set
+	Compress bool
+	// EncryptionKey encrypts new objects with AES-256-GCM if set, and is
+	// needed to read objects which were encrypted
+	EncryptionKey []byte
+	// Chunk stores new objects as content-defined chunks, which are shared
+	// with any other object containing the same data
+	Chunk bool
+	// CacheDir is a local folder to keep copies of downloaded objects in, so
+	// they're only read from the store once
+	CacheDir string
+	// CacheLimit is the most bytes to leave in CacheDir, or 0 for no limit
+	CacheLimit int64
+	// Mirrors are more stores which get a copy of every object uploaded, and
+	// are read from if the base directory is missing an object
+	Mirrors []string
+	// Quorum is how many stores (including the base directory) an upload has
+	// to succeed on when there are mirrors, 0 meaning all of them
+	Quorum int
+	// Fallbacks are read-only stores which are tried in order for downloads
+	// which none of the other stores have, e.g. a store which was migrated from
+	Fallbacks []string
+	// BackFill copies objects which were only found in a fallback store into
+	// the base directory (and mirrors)
+	BackFill bool
+	// FastCopy lets the OS copy objects between files, using a reflink or
+	// copy_file_range where the filesystem supports it
+	FastCopy bool
+	// CleanupAge removes temp files older than this, which were left by
+	// interrupted transfers, when the adapter starts. 0 means never
+	CleanupAge time.Duration
+	// UploadLimit and DownloadLimit are the most bytes per second to transfer
+	// to and from the store, shared between all the transfers at once. 0 means
+	// no limit
+	UploadLimit   int64
+	DownloadLimit int64
+	// Audit appends a line to the audit log in the base directory for every
+	// transfer, saying who made it and whether it succeeded
+	Audit bool
+	// RemoteBaseDirs maps the names of git remotes to the base directory to
+	// use for them instead of the default
+	RemoteBaseDirs map[string]string
+	// LogLevel is the most verbose level of log entries written, 0 meaning
+	// util.LogInfo
+	LogLevel util.LogLevel
+	// LogJSON writes log entries as JSON objects rather than text
+	LogJSON bool
+	// LogFile is a file to append log entries to instead of stderr
+	LogFile string
+}
+
+// Config is everything Serve needs to know, however it was configured
+type Config struct {
+	// BaseDir is the store to use for remotes which aren't in
+	// RemoteBaseDirs. It can be blank if every remote is
+	BaseDir string
+	Options
+}
+
+// OpenStore opens the store at a location, adding the compression and
+// encryption layers described by opts
+func OpenStore(location string, opts Options) (backend.Backend, error) {
+	storage, err := backend.New(location)
+	if err != nil {
+		return nil, err
+	}
+	// Compression has to happen first, encrypted data doesn't compress
+	layered := func(b backend.Backend) (backend.Backend, error) {
+		encrypted, err := backend.NewEncrypted(b, opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		return backend.NewCompressed(encrypted, opts.Compress), nil
+	}
+	objects, err := layered(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, ok := storage.(backend.Namespaced)
+	if !ok {
+		if opts.Chunk {
+			return nil, fmt.Errorf("%v does not support chunking", location)
+		}
+		return objects, nil
+	}
+	chunkStore, err := ns.Namespace(backend.ChunksNamespace)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := layered(chunkStore)
+	if err != nil {
+		return nil, err
+	}
+	return backend.NewChunked(storage, objects, chunks, opts.Chunk), nil
+}
+
+// stores are what Serve transfers to and from
+type stores struct {
+	// storage is where uploads go, which may be mirrored
+	storage backend.Backend
+	// downloads are tried in order until one has a good copy of the object
+	downloads []backend.Backend
+	// firstFallback is the index in downloads of the first read-only store
+	firstFallback int
+	// caches are in front of each of downloads, if there's a cache dir
+	caches []*backend.Cache
+	// uploadLimit and downloadLimit are shared by every transfer in the
+	// session, nil if there's no limit
+	uploadLimit   *rateLimiter
+	downloadLimit *rateLimiter
+	// audit records transfers, nil if they aren't audited
+	audit *auditLog
+}
+
+// openStores opens the base directory, mirrors, fallbacks and cache. Mirrors
+// which aren't available are left out as long as there are enough left for a
+// quorum, and fallbacks which aren't available are just left out.
+func openStores(baseDir, gitDir string, opts Options, log *util.Logger) (*stores, error) {
+	locations := append([]string{baseDir}, opts.Mirrors...)
+	quorum := opts.Quorum
+	if quorum <= 0 || quorum > len(locations) {
+		quorum = len(locations)
+	}
+	var available []backend.Backend
+	var firstErr error
+	for _, location := range locations {
+		storage, err := OpenStore(location, opts)
+		if err != nil {
+			if len(locations) > 1 {
+				log.Warnf("Store %q is not available: %v", location, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		available = append(available, storage)
+	}
+	if len(available) < quorum {
+		if len(locations) == 1 {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("Only %d of %d stores are available, %d needed", len(available), len(locations), quorum)
+	}
+
+	s := &stores{
+		storage:       available[0],
+		downloads:     available,
+		firstFallback: len(available),
+	}
+	if len(locations) > 1 {
+		s.storage = backend.NewMirrored(available, quorum)
+	}
+	for _, location := range opts.Fallbacks {
+		// Nothing is ever written to these, so options for new objects
+		// don't matter
+		storage, err := OpenStore(location, Options{EncryptionKey: opts.EncryptionKey})
+		if err != nil {
+			log.Warnf("Fallback store %q is not available: %v", location, err)
+			continue
+		}
+		s.downloads = append(s.downloads, storage)
+	}
+	if opts.Audit {
+		var err error
+		if s.audit, err = openAuditLog(baseDir, gitDir); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.CacheDir) > 0 {
+		for i, storage := range s.downloads {
+			// Uploads always check what's really in the store
+			cache, err := backend.NewCache(storage, opts.CacheDir)
+			if err != nil {
+				return nil, err
+			}
+			s.caches = append(s.caches, cache)
+			s.downloads[i] = cache
+		}
+	}
+	return s, nil
+}
+
+// openLog creates the logger for Serve, and returns a function to close it
+func openLog(opts Options, stderr io.Writer) (*util.Logger, func()) {
+	if len(opts.LogFile) == 0 {
+		return util.NewLogger(stderr, opts.LogLevel, opts.LogJSON), func() {}
+	}
+	f, err := os.OpenFile(opts.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log := util.NewLogger(stderr, opts.LogLevel, opts.LogJSON)
+		log.Warnf("Unable to open log file %q: %v", opts.LogFile, err)
+		return log, func() {}
+	}
+	return util.NewLogger(f, opts.LogLevel, opts.LogJSON), func() { f.Close() }
+}
+
 // Serve starts the protocol server
-func Serve(baseDir string, stdin io.Reader, stdout, stderr io.Writer) {
+func Serve(config Config, stdin io.Reader, stdout, stderr io.Writer) {
+	baseDir, opts := config.BaseDir, config.Options
 
 	scanner := bufio.NewScanner(stdin)
-	writer := bufio.NewWriter(stdout)
-	errWriter := bufio.NewWriter(stderr)
+	// Transfers can run concurrently, so every goroutine gets its own writer
+	// which only ever passes whole lines through to the shared stream
+	out := &sharedOutput{w: stdout}
+	writer := out.newWriter()
+	log, closeLog := openLog(opts, stderr)
+	defer closeLog()
 
 	gitDir, err := gitDir()
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to retrieve git dir: %v\n", err), errWriter)
+		log.Errorf("Unable to retrieve git dir: %v", err)
 		return
 	}
 
+	sess := newSession(baseDir, gitDir, opts, log)
+	defer sess.close()
+
+	run := func(req *api.Request, writer *bufio.Writer) {
+		rs := sess.storesFor(req.Remote)
+		if rs.stores == nil {
+			api.SendTransferError(req.Oid, 9, "Base directory not specified or not available, check config", writer, log)
+			return
+		}
+		transfer(rs.stores, gitDir, opts, req, writer, log)
+	}
+	var pool *transferPool
+	defer func() {
+		if pool != nil {
+			pool.wait()
+		}
+	}()
+	// remote is the one git-lfs said it's using in init, which transfers go to
+	var remote string
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		var req api.Request
 
 		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			util.WriteToStderr(fmt.Sprintf("Unable to parse request: %v\n", line), errWriter)
+			log.Errorf("Unable to parse request: %v", line)
 			continue
 		}
 
 		switch req.Event {
 		case "init":
+			remote = req.Remote
+			rs := sess.storesFor(remote)
 			resp := &api.InitResponse{}
-			if len(baseDir) == 0 {
+			if rs.err != nil {
+				resp.Error = &api.TransferError{Code: 9, Message: fmt.Sprintf("Cannot use store: %v", rs.err)}
+			} else if len(rs.baseDir) == 0 {
 				resp.Error = &api.TransferError{Code: 9, Message: "Base directory not specified, check config"}
 			} else {
-				util.WriteToStderr(fmt.Sprintf("Initialised lfs-folderstore custom adapter for %s\n", req.Operation), errWriter)
+				log.Infof("Initialised lfs-folderstore custom adapter for %s to %v", req.Operation, rs.baseDir)
+				sess.sweep(rs)
+			}
+			if pool == nil {
+				pool = newTransferPool(workerCount(&req), out, run)
 			}
-			api.SendResponse(resp, writer, errWriter)
-		case "download":
-			util.WriteToStderr(fmt.Sprintf("Received download request for %s\n", req.Oid), errWriter)
-			retrieve(baseDir, gitDir, req.Oid, req.Size, req.Action, writer, errWriter)
-		case "upload":
-			util.WriteToStderr(fmt.Sprintf("Received upload request for %s\n", req.Oid), errWriter)
-			store(baseDir, req.Oid, req.Size, req.Action, req.Path, writer, errWriter)
+			api.SendResponse(resp, writer, log)
+		case "download", "upload":
+			if pool == nil {
+				// No init received, fall back on sequential transfers
+				pool = newTransferPool(1, out, run)
+			}
+			req.Remote = remote
+			pool.submit(&req)
 		case "terminate":
-			util.WriteToStderr("Terminating test custom adapter gracefully.\n", errWriter)
-			break
+			log.Infof("Terminating test custom adapter gracefully.")
+			if pool != nil {
+				// let in-flight transfers finish before we go
+				pool.wait()
+				pool = nil
+			}
+		}
+	}
+
+}
+
+// transfer performs a single upload or download request
+func transfer(stores *stores, gitDir string, opts Options, req *api.Request, writer *bufio.Writer, log *util.Logger) {
+	log = log.With(util.Fields{"oid": req.Oid, "size": req.Size, "operation": req.Event})
+	start := time.Now()
+	var path string
+	var terr *api.TransferError
+	switch req.Event {
+	case "download":
+		log.Infof("Received download request")
+		path, terr = retrieve(stores, opts, gitDir, req.Oid, req.Size, req.Action, writer, log)
+	case "upload":
+		log.Infof("Received upload request")
+		terr = store(stores.storage, opts, stores.uploadLimit, req.Oid, req.Size, req.Action, req.Path, writer, log)
+	}
+	logTransfer(log, time.Since(start), req.Size, terr)
+	if stores.audit != nil {
+		// Not fatal, the transfer itself is done
+		if err := stores.audit.record(req.Remote, req.Event, req.Oid, req.Size, terr); err != nil {
+			log.Warnf("Unable to write audit log: %v", err)
 		}
 	}
 
+	complete := &api.TransferResponse{Event: "complete", Oid: req.Oid, Path: path, Error: terr}
+	if err := api.SendResponse(complete, writer, log); err != nil {
+		log.Errorf("Unable to send completion message: %v", err)
+	}
 }
 
-func storagePath(baseDir string, oid string) string {
-	// Use same folder split as lfs itself
-	fld := filepath.Join(baseDir, oid[0:2], oid[2:4])
-	return filepath.Join(fld, oid)
+// logTransfer logs the outcome of a transfer, with how long it took
+func logTransfer(log *util.Logger, elapsed time.Duration, size int64, terr *api.TransferError) {
+	fields := util.Fields{"duration_ms": elapsed.Nanoseconds() / int64(time.Millisecond)}
+	if elapsed > 0 {
+		fields["bytes_per_sec"] = int64(float64(size) / elapsed.Seconds())
+	}
+	if terr != nil {
+		fields["code"] = terr.Code
+		log.With(fields).Errorf("Transfer failed: %v", terr.Message)
+	} else {
+		log.With(fields).Infof("Transfer complete")
+	}
+}
+
+func downloadTempDir(gitDir string) string {
+	return filepath.Join(gitDir, "lfs", "tmp")
 }
 
 func downloadTempPath(gitDir string, oid string) string {
 	// Download to a subfolder of repo so that git-lfs's final rename can work
 	// It won't work if TEMP is on another drive otherwise
 	// basedir is the objects/ folder, so use the tmp folder
-	tmpfld := filepath.Join(gitDir, "lfs", "tmp")
+	tmpfld := downloadTempDir(gitDir)
 	os.MkdirAll(tmpfld, os.ModePerm)
 	return filepath.Join(tmpfld, fmt.Sprintf("%v.tmp", oid))
 }
 
-func retrieve(baseDir, gitDir, oid string, size int64, a *api.Action, writer, errWriter *bufio.Writer) {
+// retrieve downloads an object from the first store which has a good copy, so
+// that if one is missing or corrupt the next is tried
+func retrieve(stores *stores, opts Options, gitDir, oid string, size int64, a *api.Action, writer *bufio.Writer, log *util.Logger) (string, *api.TransferError) {
+	var terr *api.TransferError
+	var dlfilename string
+	var found int
+	for i, storage := range stores.downloads {
+		dlfilename, terr = retrieveFrom(storage, opts, stores.downloadLimit, gitDir, oid, size, writer, log)
+		found = i
+		// Nothing else can help if we can't write locally
+		if terr == nil || terr.Code == 5 {
+			break
+		}
+		if i < len(stores.downloads)-1 {
+			log.Warnf("%v, trying next store", terr.Message)
+		}
+	}
+	if terr != nil {
+		return "", terr
+	}
+
+	if opts.BackFill && found >= stores.firstFallback {
+		// Not fatal, lfs has what it asked for
+		if err := backFill(stores.storage, oid, size, dlfilename); err != nil {
+			log.Warnf("Unable to copy %v from fallback store: %v", oid, err)
+		} else {
+			log.Infof("Copied %v from fallback store", oid)
+		}
+	}
+
+	return dlfilename, nil
+}
+
+// backFill adds an object which was downloaded from a fallback store to the
+// main store, from the downloaded copy
+func backFill(storage backend.Backend, oid string, size int64, path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeObject(storage, oid, size, f)
+}
+
+// retrieveFrom downloads an object from one store to the temp file lfs will
+// pick it up from, at no more than limit allows, and returns the temp file path
+func retrieveFrom(storage backend.Backend, opts Options, limit *rateLimiter, gitDir, oid string, size int64, writer *bufio.Writer, log *util.Logger) (string, *api.TransferError) {
 
 	// We just use a shared DB of objects stored by OID across all repos
 	// If user wants to separate, can just use a different folder
-	filePath := storagePath(baseDir, oid)
-	stat, err := os.Stat(filePath)
-	if err != nil {
-		api.SendTransferError(oid, 3, fmt.Sprintf("Cannot stat %q: %v", filePath, err), writer, errWriter)
-		return
+	info, err := storage.Stat(oid)
+	if _, ok := err.(*backend.CorruptObjectError); ok {
+		return "", &api.TransferError{Code: 4, Message: err.Error()}
+	} else if _, ok := err.(*backend.KeyError); ok {
+		return "", &api.TransferError{Code: 10, Message: err.Error()}
+	} else if err != nil {
+		return "", &api.TransferError{Code: 3, Message: fmt.Sprintf("Cannot stat %v: %v", oid, err)}
 	}
 
-	if !stat.Mode().IsRegular() {
-		api.SendTransferError(oid, 4, fmt.Sprintf("Store corruption, %q is not a regular file", filePath), writer, errWriter)
-		return
+	if info.Size != size {
+		return "", &api.TransferError{Code: 8, Message: fmt.Sprintf("Store corruption, %v is %d bytes but expected %d", oid, info.Size, size)}
 	}
 
 	// Copy to temp, since LFS will rename this to final location
 	// Use git dir as base to ensure final path is on same drive for LFS move
+	// Anything an interrupted attempt checkpointed is kept and carried on from
 	dlfilename := downloadTempPath(gitDir, oid)
-	dlFile, err := os.OpenFile(dlfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	dlFile, state, err := openPartialDownload(dlfilename, size)
 	if err != nil {
-		api.SendTransferError(oid, 5, fmt.Sprintf("Error creating temp file for %q: %v", filePath, err), writer, errWriter)
-		return
+		return "", &api.TransferError{Code: 5, Message: fmt.Sprintf("Error creating temp file for %v: %v", oid, err)}
 	}
 	defer dlFile.Close()
 
-	f, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	f, err := storage.Open(oid)
 	if err != nil {
-		api.SendTransferError(oid, 6, fmt.Sprintf("Cannot read data from %q: %v", filePath, err), writer, errWriter)
-		os.Remove(dlfilename)
-		return
+		return "", &api.TransferError{Code: 6, Message: fmt.Sprintf("Cannot read data for %v: %v", oid, err)}
 	}
 	defer f.Close()
 
-	cb := func(totalSize, readSoFar int64, readSinceLast int) error {
-		api.SendProgress(oid, readSoFar, readSinceLast, writer, errWriter)
+	if state.offset > 0 {
+		log.Infof("Resuming download of %v from %d bytes", oid, state.offset)
+		if err := skipTo(f, state.offset); err != nil {
+			return "", &api.TransferError{Code: 7, Message: fmt.Sprintf("Error copying %v: %v", oid, err)}
+		}
+	}
+
+	cb := throttleProgress(func(totalSize, readSoFar int64, readSinceLast int) error {
+		api.SendProgress(oid, readSoFar, readSinceLast, writer, log)
 		return nil
+	})
+	checkpoint := func(state *resumeState) error {
+		return checkpointDownload(dlFile, dlfilename, size, state)
 	}
 
-	err = copyFileContents(stat.Size(), f, dlFile, cb)
+	// A limited reader is never copied by the OS, so fast copy is skipped
+	hash, err := copyTransfer(size, limitReader(f, limit), dlFile, state, checkpoint, opts.FastCopy, cb)
 	if err != nil {
-		api.SendTransferError(oid, 7, fmt.Sprintf("Error copy file from %q: %v", filePath, err), writer, errWriter)
-		dlFile.Close()
-		os.Remove(dlfilename)
-		return
+		// Keep what was checkpointed for the next attempt
+		return "", &api.TransferError{Code: 7, Message: fmt.Sprintf("Error copying %v: %v", oid, err)}
 	}
 
-	if err := dlFile.Close(); err != nil {
-		api.SendTransferError(oid, 5, fmt.Sprintf("can't close tempfile %q: %v", dlfilename, err), writer, errWriter)
-		os.Remove(dlfilename)
-		return
+	// Don't give lfs anything which doesn't match what it asked for
+	if hash != oid {
+		dlFile.Close()
+		removePartialDownload(dlfilename)
+		return "", &api.TransferError{Code: 8, Message: fmt.Sprintf("Store corruption, content of %v has SHA-256 %v", oid, hash)}
 	}
 
-	// completed
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: dlfilename, Error: nil}
-	err = api.SendResponse(complete, writer, errWriter)
-	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
+	if err := dlFile.Close(); err != nil {
+		removePartialDownload(dlfilename)
+		return "", &api.TransferError{Code: 5, Message: fmt.Sprintf("can't close tempfile %q: %v", dlfilename, err)}
 	}
+	os.Remove(downloadStatePath(dlfilename))
+	return dlfilename, nil
 }
 
 type copyCallback func(totalSize int64, readSoFar int64, readSinceLast int) error
 
-func copyFileContents(size int64, src, dst *os.File, cb copyCallback) error {
+// copyFileContents copies exactly size bytes from src to dst, and returns the
+// SHA-256 of everything copied so it can be checked against the oid
+func copyFileContents(size int64, src io.Reader, dst io.Writer, cb copyCallback) (string, error) {
+	return copyResumable(size, src, dst, newResumeState(), nil, cb)
+}
+
+// copyResumable is copyFileContents carrying on from state, with src and dst
+// already positioned there. state is updated as it goes, and checkpoint, if
+// given, is called with it every checkpointInterval bytes.
+func copyResumable(size int64, src io.Reader, dst io.Writer, state *resumeState, checkpoint func(*resumeState) error, cb copyCallback) (string, error) {
 	// copy file in chunks (4K is usual block size of disks)
 	const blockSize int64 = 4 * 1024 * 16
 
+	out := io.MultiWriter(dst, state.hasher)
+
+	// Let lfs know about what was already done
+	if state.offset > 0 && cb != nil {
+		cb(size, state.offset, int(state.offset))
+	}
+	lastCheckpoint := state.offset
+
 	// Read precisely the correct number of bytes
-	bytesLeft := size
+	bytesLeft := size - state.offset
 	for bytesLeft > 0 {
 		nextBlock := blockSize
-		if nextBlock < bytesLeft {
+		if nextBlock > bytesLeft {
 			nextBlock = bytesLeft
 		}
-		n, err := io.CopyN(dst, src, nextBlock)
+		n, err := io.CopyN(out, src, nextBlock)
 		bytesLeft -= n
-		if err != nil && err != io.EOF {
-			return err
+		state.offset += n
+		if err == io.EOF {
+			return "", fmt.Errorf("unexpected end of data, %d of %d bytes read", size-bytesLeft, size)
+		} else if err != nil {
+			return "", err
 		}
 		readSoFar := size - bytesLeft
 		if cb != nil {
 			cb(size, readSoFar, int(n))
 		}
+		if checkpoint != nil && bytesLeft > 0 && state.offset-lastCheckpoint >= checkpointInterval {
+			if err := checkpoint(state); err != nil {
+				return "", fmt.Errorf("cannot record progress: %v", err)
+			}
+			lastCheckpoint = state.offset
+		}
 	}
-	return nil
+	return hex.EncodeToString(state.hasher.Sum(nil)), nil
 }
 
-func store(baseDir string, oid string, size int64, a *api.Action, fromPath string, writer, errWriter *bufio.Writer) {
+func store(storage backend.Backend, opts Options, limit *rateLimiter, oid string, size int64, a *api.Action, fromPath string, writer *bufio.Writer, log *util.Logger) *api.TransferError {
 	statFrom, err := os.Stat(fromPath)
 	if err != nil {
-		api.SendTransferError(oid, 13, fmt.Sprintf("Cannot stat %q: %v", fromPath, err), writer, errWriter)
-		return
+		return &api.TransferError{Code: 13, Message: fmt.Sprintf("Cannot stat %q: %v", fromPath, err)}
 	}
 
-	destPath := storagePath(baseDir, oid)
-
-	statDest, err := os.Stat(destPath)
-	if err == nil {
-		// if file exists, skip if already the same size
-		if statFrom.Size() == statDest.Size() {
-			util.WriteToStderr(fmt.Sprintf("Skipping %v, already stored", oid), errWriter)
+	if statFrom.Size() != size {
+		return &api.TransferError{Code: 19, Message: fmt.Sprintf("Local file %q is %d bytes but expected %d", fromPath, statFrom.Size(), size)}
+	}
 
+	info, err := storage.Stat(oid)
+	if _, ok := err.(*backend.KeyError); ok {
+		// Don't replace it, everyone else would lose access
+		return &api.TransferError{Code: 10, Message: err.Error()}
+	} else if err == nil && info.Size == size {
+		// if file exists, skip if it's already the correct content
+		valid, err := storedObjectValid(storage, oid, opts.ChecksumCache)
+		if err != nil {
+			log.Warnf("Unable to check existing %v, replacing: %v", oid, err)
+		} else if !valid {
+			log.Warnf("Existing %v is corrupt, replacing", oid)
+		} else {
+			log.Infof("Skipping %v, already stored", oid)
 			// send full progress
-			api.SendProgress(oid, statFrom.Size(), int(statFrom.Size()), writer, errWriter)
-			// send completion
-			complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-			err = api.SendResponse(complete, writer, errWriter)
-			if err != nil {
-				util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-			}
-			return
+			api.SendProgress(oid, size, int(size), writer, log)
+			return nil
 		}
 	}
 
-	err = os.MkdirAll(filepath.Dir(destPath), 0755)
+	// Wait for anyone else uploading the same object
+	unlock, err := backend.Lock(storage, oid)
 	if err != nil {
-		api.SendTransferError(oid, 14, fmt.Sprintf("Cannot create dir %q: %v", filepath.Dir(destPath), err), writer, errWriter)
-		return
+		return &api.TransferError{Code: 16, Message: fmt.Sprintf("Cannot lock %v: %v", oid, err)}
 	}
-
-	// write a temp file in same folder, then rename
-	tempPath := fmt.Sprintf("%v.tmp", destPath)
-	if _, err := os.Stat(tempPath); err == nil {
-		// delete temp file
-		err := os.Remove(tempPath)
-		if err != nil && !os.IsNotExist(err) {
-			api.SendTransferError(oid, 14, fmt.Sprintf("Cannot remove existing temp file %q: %v", tempPath, err), writer, errWriter)
-			return
+	defer unlock()
+	if info == nil {
+		// If they've finished, there's nothing left to do
+		if info, err := storage.Stat(oid); err == nil && info.Size == size {
+			if valid, err := storedObjectValid(storage, oid, opts.ChecksumCache); err == nil && valid {
+				log.Infof("Skipping %v, stored by someone else", oid)
+				api.SendProgress(oid, size, int(size), writer, log)
+				return nil
+			}
 		}
 	}
 
 	srcf, err := os.OpenFile(fromPath, os.O_RDONLY, 0644)
 	if err != nil {
-		api.SendTransferError(oid, 15, fmt.Sprintf("Cannot read data from %q: %v", fromPath, err), writer, errWriter)
-		return
+		return &api.TransferError{Code: 15, Message: fmt.Sprintf("Cannot read data from %q: %v", fromPath, err)}
 	}
 	defer srcf.Close()
 
-	dstf, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, statFrom.Mode())
-	if err != nil {
-		api.SendTransferError(oid, 16, fmt.Sprintf("Cannot open temp file for writing %q: %v", tempPath, err), writer, errWriter)
-		return
+	// Large objects carry on from where an interrupted upload stopped
+	var dst backend.ObjectWriter
+	var checkpoint func(*resumeState) error
+	state := newResumeState()
+	resumable, resumed, err := createResumable(storage, oid, size)
+	if err == nil {
+		if resumed.offset > 0 {
+			log.Infof("Resuming upload of %v from %d bytes", oid, resumed.offset)
+		}
+		if err := skipTo(srcf, resumed.offset); err != nil {
+			resumable.Suspend()
+			return &api.TransferError{Code: 15, Message: fmt.Sprintf("Cannot read data from %q: %v", fromPath, err)}
+		}
+		dst, state = resumable, resumed
+		checkpoint = func(state *resumeState) error {
+			data, err := state.encode(size)
+			if err != nil {
+				return err
+			}
+			return resumable.Checkpoint(data)
+		}
+	} else if err != backend.ErrNotResumable {
+		return &api.TransferError{Code: 16, Message: fmt.Sprintf("Cannot write %v: %v", oid, err)}
+	} else if dst, err = storage.Create(oid, size); err != nil {
+		return &api.TransferError{Code: 16, Message: fmt.Sprintf("Cannot write %v: %v", oid, err)}
 	}
-	defer dstf.Close()
 
-	cb := func(totalSize, readSoFar int64, readSinceLast int) error {
-		api.SendProgress(oid, readSoFar, readSinceLast, writer, errWriter)
+	cb := throttleProgress(func(totalSize, readSoFar int64, readSinceLast int) error {
+		api.SendProgress(oid, readSoFar, readSinceLast, writer, log)
 		return nil
-	}
+	})
 
-	err = copyFileContents(statFrom.Size(), srcf, dstf, cb)
+	hash, err := copyTransfer(size, limitReader(srcf, limit), dst, state, checkpoint, opts.FastCopy, cb)
 	if err != nil {
-		api.SendTransferError(oid, 17, fmt.Sprintf("Error writing temp file %q: %v", tempPath, err), writer, errWriter)
-		dstf.Close()
-		os.Remove(tempPath)
-		return
+		if resumable != nil {
+			// Keep what was checkpointed for the next attempt
+			resumable.Suspend()
+		} else {
+			dst.Abort()
+		}
+		return &api.TransferError{Code: 17, Message: fmt.Sprintf("Error writing %v: %v", oid, err)}
 	}
 
-	// now rename
-	dstf.Close()
-	err = os.Rename(tempPath, destPath)
-	if err != nil {
-		api.SendTransferError(oid, 18, fmt.Sprintf("Error moving temp file to final location: %v", err), writer, errWriter)
-		os.Remove(tempPath)
-		return
+	// Never let bad content into the store under this oid
+	if hash != oid {
+		dst.Abort()
+		return &api.TransferError{Code: 19, Message: fmt.Sprintf("Content of %q has SHA-256 %v, does not match oid", fromPath, hash)}
 	}
 
-	// completed
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-	err = api.SendResponse(complete, writer, errWriter)
-	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
+	if err := dst.Commit(); err != nil {
+		return &api.TransferError{Code: 18, Message: err.Error()}
+	}
+
+	if cache, ok := storage.(backend.VerifiedCache); ok && opts.ChecksumCache {
+		if err := cache.SetVerified(oid); err != nil {
+			log.Warnf("Unable to write checksum cache for %v: %v", oid, err)
+		}
 	}
 
+	return nil
 }
 
 func gitDir() (string, error) {
+	return repoGitDir("")
+}
+
+// repoGitDir returns the git dir of the repository in dir, or the current
+// directory if dir is blank
+func repoGitDir(dir string) (string, error) {
 	cmd := util.NewCmd("git", "rev-parse", "--git-dir")
+	cmd.Dir = dir
 	out, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("Failed to call git rev-parse --git-dir: %v %v", err, string(out))
 	}
 	path := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
 	return absPath(path)
 
 }
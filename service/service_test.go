@@ -1,66 +1,27 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/sinbad/lfs-folderstore/util"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestStoragePath(t *testing.T) {
-	type args struct {
-		baseDir string
-		oid     string
-	}
-	tests := []struct {
-		name string
-		args args
-		want string
-	}{
-		// platform-specific tests still run but use filepath.Join to make consistent
-		{
-			name: "Windows drive",
-			args: args{baseDir: `C:/Storage/Dir`, oid: "123456789abcdef"},
-			want: filepath.Join(`C:/Storage/Dir`, "12", "34", "123456789abcdef"),
-		},
-		{
-			name: "Windows drive with space",
-			args: args{baseDir: `C:/Storage Path/Dir`, oid: "123456789abcdef"},
-			want: filepath.Join(`C:/Storage Path/Dir`, "12", "34", "123456789abcdef"),
-		},
-		{
-			name: "Windows share",
-			args: args{baseDir: `\\MyServer\Storage Path\Dir`, oid: "123456789abcdef"},
-			want: filepath.Join(`\\MyServer\Storage Path\Dir`, "12", "34", "123456789abcdef"),
-		},
-		{
-			name: "Windows trailing separator",
-			args: args{baseDir: `C:/Storage/Dir/`, oid: "123456789abcdef"},
-			want: filepath.Join(`C:/Storage/Dir`, "12", "34", "123456789abcdef"),
-		},
-		{
-			name: "Unix path",
-			args: args{baseDir: `/home/bob/`, oid: "123456789abcdef"},
-			want: filepath.Join(`/home/bob`, "12", "34", "123456789abcdef"),
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := storagePath(tt.args.baseDir, tt.args.oid); got != tt.want {
-				t.Errorf("storagePath() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func addUpload(t *testing.T, buf *bytes.Buffer, path, oid string, size int64) {
 	req := &api.Request{
 		Event:  "upload",
@@ -96,7 +57,7 @@ func TestUpload(t *testing.T) {
 	var stderr bytes.Buffer
 
 	// Perform entire sequence
-	Serve(setup.remotepath, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
 
 	// Check reported progress and completion
 	stdoutStr := stdout.String()
@@ -126,7 +87,7 @@ func TestUpload(t *testing.T) {
 	setup2 := setupUploadTest2(t, setup.localpath, setup.remotepath)
 	stdout.Reset()
 	stderr.Reset()
-	Serve(setup2.remotepath, bytes.NewReader(setup2.inputBuffer.Bytes()), &stdout, &stderr)
+	Serve(Config{BaseDir: setup2.remotepath}, bytes.NewReader(setup2.inputBuffer.Bytes()), &stdout, &stderr)
 
 	stdoutStr = stdout.String()
 	stderrStr := stderr.String()
@@ -156,6 +117,754 @@ func TestUpload(t *testing.T) {
 
 }
 
+func TestUploadReplacesCorrupt(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	opts := Options{ChecksumCache: true}
+	Serve(Config{BaseDir: setup.remotepath, Options: opts}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// Damage a stored object without changing its size
+	bad := setup.files[1]
+	badPath := backend.StoragePath(setup.remotepath, bad.oid)
+	assert.FileExists(t, badPath+backend.ChecksumSuffix)
+	f, err := os.OpenFile(badPath, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, 100)
+	assert.Nil(t, err)
+	f.Close()
+
+	// A local file which doesn't match the oid it's being pushed as
+	liar := setup.files[0]
+	assert.Nil(t, os.Remove(liar.path))
+	createTestFile(t, liar.size-1, liar.path)
+	liar.oid = setup.files[2].oid
+
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	addUpload(t, &commandBuf, bad.path, bad.oid, bad.size)
+	addUpload(t, &commandBuf, liar.path, liar.oid, liar.size-1)
+	finishUpload(&commandBuf)
+
+	stdout.Reset()
+	stderr.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: opts}, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	assert.Contains(t, stderr.String(), "Existing "+bad.oid+" is corrupt")
+	assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+bad.oid+`"}`)
+	assert.Equal(t, bad.oid, calculateFileHash(t, badPath))
+	assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+liar.oid+`","error":{"code":19`)
+	assert.Equal(t, liar.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, liar.oid)))
+}
+
+func TestConcurrentResponses(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// Transfers run in parallel, but every line must still be a whole message
+	completed := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(stdout.Bytes()), []byte("\n")) {
+		var resp map[string]interface{}
+		assert.Nil(t, json.Unmarshal(line, &resp), "Interleaved response: %q", line)
+		if resp["event"] == "complete" {
+			assert.Nil(t, resp["error"])
+			completed++
+		}
+	}
+	assert.Equal(t, len(setup.files), completed)
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Two people pushing the same objects at once both succeed
+	outputs := make([]bytes.Buffer, 2)
+	done := make(chan struct{})
+	for i := range outputs {
+		go func(stdout *bytes.Buffer) {
+			var stderr bytes.Buffer
+			Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), stdout, &stderr)
+			done <- struct{}{}
+		}(&outputs[i])
+	}
+	for range outputs {
+		<-done
+	}
+	for _, stdout := range outputs {
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		}
+	}
+	for _, file := range setup.files {
+		assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, file.oid)))
+		leftovers, err := filepath.Glob(backend.StoragePath(setup.remotepath, file.oid) + ".*")
+		assert.Nil(t, err)
+		assert.Empty(t, leftovers)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	// Same protocol, different store
+	Serve(Config{BaseDir: "mem://TestMemoryBackend"}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	mem := backend.NamedMemory("TestMemoryBackend")
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`"}`)
+		info, err := mem.Stat(file.oid)
+		assert.Nil(t, err)
+		assert.Equal(t, file.size, info.Size)
+	}
+	// Nothing written to the folder
+	entries, err := ioutil.ReadDir(setup.remotepath)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	var commandBuf bytes.Buffer
+	initDownload(&commandBuf)
+	for _, file := range setup.files {
+		addDownload(t, &commandBuf, file.oid, file.size)
+	}
+	finishDownload(&commandBuf)
+
+	stdout.Reset()
+	Serve(Config{BaseDir: "mem://TestMemoryBackend"}, &commandBuf, &stdout, &stderr)
+	stdoutStr = stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+	}
+}
+
+func TestCompressed(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{Compress: true}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`"}`)
+		storeFile := backend.StoragePath(setup.remotepath, file.oid)
+		data, err := ioutil.ReadFile(storeFile)
+		assert.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(data, []byte("\x89LFSZST\n")), "Should be stored compressed")
+		assert.True(t, int64(len(data)) < file.size, "Should be smaller than the original")
+	}
+
+	// Mix in an uncompressed object
+	plain := setup.files[0]
+	os.Remove(backend.StoragePath(setup.remotepath, plain.oid))
+	stdout.Reset()
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	addUpload(t, &commandBuf, plain.path, plain.oid, plain.size)
+	finishUpload(&commandBuf)
+	Serve(Config{BaseDir: setup.remotepath}, &commandBuf, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+plain.oid+`"}`)
+	plainStat, err := os.Stat(backend.StoragePath(setup.remotepath, plain.oid))
+	assert.Nil(t, err)
+	assert.Equal(t, plain.size, plainStat.Size())
+
+	// Both read back without compression enabled
+	commandBuf.Reset()
+	initDownload(&commandBuf)
+	for _, file := range setup.files {
+		addDownload(t, &commandBuf, file.oid, file.size)
+	}
+	finishDownload(&commandBuf)
+
+	stdout.Reset()
+	Serve(Config{BaseDir: setup.remotepath}, &commandBuf, &stdout, &stderr)
+	stdoutStr = stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+		assert.Contains(t, stdoutStr, fmt.Sprintf(`{"event":"progress","oid":"%v","bytesSoFar":%d,`, file.oid, file.size))
+	}
+
+	report, err := Verify(setup.remotepath, nil, 2)
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "Compressed objects should verify")
+}
+
+func TestEncrypted(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	key, err := backend.ParseKey(strings.Repeat("0123456789abcdef", 4))
+	assert.Nil(t, err)
+	opts := Options{EncryptionKey: key, Compress: true}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(Config{BaseDir: setup.remotepath, Options: opts}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`"}`)
+		data, err := ioutil.ReadFile(backend.StoragePath(setup.remotepath, file.oid))
+		assert.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(data, []byte("\x89LFSENC\n")), "Should be stored encrypted")
+		plain, err := ioutil.ReadFile(file.path)
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, plain[:64]), "Content should not be readable")
+	}
+
+	var commandBuf bytes.Buffer
+	download := func() {
+		commandBuf.Reset()
+		initDownload(&commandBuf)
+		for _, file := range setup.files {
+			addDownload(t, &commandBuf, file.oid, file.size)
+		}
+		finishDownload(&commandBuf)
+	}
+
+	download()
+	stdout.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{EncryptionKey: key}}, &commandBuf, &stdout, &stderr)
+	stdoutStr = stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+	}
+
+	report, err := Verify(setup.remotepath, key, 2)
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "Encrypted objects should verify with the key")
+
+	// Wrong or missing key must fail cleanly
+	otherKey, err := backend.ParseKey(strings.Repeat("fedcba9876543210", 4))
+	assert.Nil(t, err)
+	for _, wrongKey := range [][]byte{otherKey, nil} {
+		download()
+		stdout.Reset()
+		Serve(Config{BaseDir: setup.remotepath, Options: Options{EncryptionKey: wrongKey}}, &commandBuf, &stdout, &stderr)
+		stdoutStr = stdout.String()
+		for _, file := range setup.files {
+			assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","error":{"code":10,"message":"Cannot decrypt `+file.oid)
+		}
+		assert.NotContains(t, stdoutStr, `"path":`)
+	}
+}
+
+func TestChunked(t *testing.T) {
+	gitpath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitpath)
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+
+	// Two versions of an asset, the second with a small edit in the middle
+	v1 := make([]byte, 10*1024*1024)
+	rand.New(rand.NewSource(1)).Read(v1)
+	v2 := append(append(append([]byte{}, v1[:5000000]...), []byte("a small edit")...), v1[5000000:]...)
+	var files []testFile
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	for i, data := range [][]byte{v1, v2} {
+		path := filepath.Join(gitpath, fmt.Sprintf("v%d", i+1))
+		assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+		file := testFile{path, int64(len(data)), calculateFileHash(t, path)}
+		files = append(files, file)
+		addUpload(t, &commandBuf, file.path, file.oid, file.size)
+	}
+	finishUpload(&commandBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	Serve(Config{BaseDir: storepath, Options: Options{Chunk: true}}, &commandBuf, &stdout, &stderr)
+	for _, file := range files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+	}
+
+	// Most of the content is only stored once
+	report, err := Verify(storepath, nil, 2)
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "Chunked objects should verify")
+	assert.Equal(t, 2, report.Objects)
+	assert.True(t, report.ChunkBytes < int64(len(v1))*3/2, "Expected chunks to be shared, %d bytes stored", report.ChunkBytes)
+
+	commandBuf.Reset()
+	initDownload(&commandBuf)
+	for _, file := range files {
+		addDownload(t, &commandBuf, file.oid, file.size)
+	}
+	finishDownload(&commandBuf)
+	stdout.Reset()
+	Serve(Config{BaseDir: storepath}, &commandBuf, &stdout, &stderr)
+	for _, file := range files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","path":`)
+	}
+
+	// Chunks only used by v1 go once v1 does, and they're old enough
+	defer func(grace time.Duration) { gcGracePeriod = grace }(gcGracePeriod)
+	gcGracePeriod = 0
+	storage, err := backend.NewFolder(storepath)
+	assert.Nil(t, err)
+	gcReport, err := GarbageCollect(storage, map[string]bool{files[1].oid: true}, nil, false)
+	assert.Nil(t, err)
+	assert.Len(t, gcReport.Unreferenced, 1)
+	assert.NotEmpty(t, gcReport.UnreferencedChunks)
+	assert.True(t, len(gcReport.UnreferencedChunks) < gcReport.Chunks/2)
+	report, err = Verify(storepath, nil, 2)
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "Remaining object should still verify")
+	assert.Equal(t, 1, report.Objects)
+}
+
+func TestCache(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	cachepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cachepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	opts := Options{CacheDir: cachepath}
+
+	// Uploads don't go in the cache
+	Serve(Config{BaseDir: setup.remotepath, Options: opts}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	_, err = os.Stat(backend.StoragePath(cachepath, setup.files[0].oid))
+	assert.True(t, os.IsNotExist(err))
+
+	var commandBuf bytes.Buffer
+	download := func() string {
+		commandBuf.Reset()
+		initDownload(&commandBuf)
+		for _, file := range setup.files {
+			addDownload(t, &commandBuf, file.oid, file.size)
+		}
+		finishDownload(&commandBuf)
+		stdout.Reset()
+		Serve(Config{BaseDir: setup.remotepath, Options: opts}, &commandBuf, &stdout, &stderr)
+		return stdout.String()
+	}
+
+	stdoutStr := download()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+		assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(cachepath, file.oid)))
+		// which knows it's good without hashing it again
+		assert.FileExists(t, backend.StoragePath(cachepath, file.oid)+backend.ChecksumSuffix)
+		// Everything else comes from the cache
+		assert.Nil(t, os.Remove(backend.StoragePath(setup.remotepath, file.oid)))
+	}
+
+	// A bad copy is never used, so this one is missing now the store doesn't
+	// have it either
+	bad := setup.files[1]
+	assert.Nil(t, ioutil.WriteFile(backend.StoragePath(cachepath, bad.oid), make([]byte, bad.size), 0644))
+	stdoutStr = download()
+	for _, file := range setup.files {
+		if file.oid == bad.oid {
+			assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","error":{"code":3,`)
+		} else {
+			assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+		}
+	}
+	_, err = os.Stat(backend.StoragePath(cachepath, bad.oid))
+	assert.True(t, os.IsNotExist(err), "Bad copy should be removed from the cache")
+
+	// Least recently used goes first
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(backend.StoragePath(cachepath, setup.files[2].oid), old, old))
+	cache, err := backend.NewCache(nil, cachepath)
+	assert.Nil(t, err)
+	removed, freed, err := cache.Prune(setup.files[0].size)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, setup.files[2].size, freed)
+	_, err = os.Stat(backend.StoragePath(cachepath, setup.files[0].oid))
+	assert.Nil(t, err)
+
+	// With a cache in front of a fallback too, the cache is still pruned
+	fallbackpath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-fallback")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fallbackpath)
+	opts.Fallbacks = []string{fallbackpath}
+	opts.CacheLimit = 1
+	download()
+	_, err = os.Stat(backend.StoragePath(cachepath, setup.files[0].oid))
+	assert.True(t, os.IsNotExist(err), "Cache should be pruned")
+}
+
+func TestMirrors(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	mirrorpath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-mirror")
+	assert.Nil(t, err)
+	defer os.RemoveAll(mirrorpath)
+	missingpath := filepath.Join(mirrorpath, "not-mounted")
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	// Can't upload without every store unless there's a quorum
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{Mirrors: []string{mirrorpath, missingpath}}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"error":{"code":9,"message":"Cannot use store: Only 2 of 3 stores are available, 3 needed"}}`)
+
+	stdout.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{Mirrors: []string{mirrorpath, missingpath}, Quorum: 2}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		for _, dir := range []string{setup.remotepath, mirrorpath} {
+			assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(dir, file.oid)))
+		}
+	}
+
+	// Downloads fall back on the mirror
+	missing, corrupt := setup.files[0], setup.files[1]
+	assert.Nil(t, os.Remove(backend.StoragePath(setup.remotepath, missing.oid)))
+	assert.Nil(t, ioutil.WriteFile(backend.StoragePath(setup.remotepath, corrupt.oid), make([]byte, corrupt.size), 0644))
+
+	var commandBuf bytes.Buffer
+	initDownload(&commandBuf)
+	for _, file := range setup.files {
+		addDownload(t, &commandBuf, file.oid, file.size)
+	}
+	finishDownload(&commandBuf)
+	stdout.Reset()
+	stderr.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{Mirrors: []string{mirrorpath}}}, &commandBuf, &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","path":`)
+	}
+	assert.Contains(t, stderr.String(), "trying next store")
+
+	report := CompareMirrors([]string{setup.remotepath, mirrorpath, missingpath})
+	assert.False(t, report.OK())
+	assert.Equal(t, 3, report.Objects)
+	assert.Equal(t, []string{missing.oid}, report.Mirrors[0].Missing)
+	assert.Empty(t, report.Mirrors[1].Missing)
+	assert.NotEmpty(t, report.Mirrors[2].Error)
+}
+
+func TestFallbacks(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	newpath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-new")
+	assert.Nil(t, err)
+	defer os.RemoveAll(newpath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	// Everything is in the old store
+	Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	var commandBuf bytes.Buffer
+	download := func(opts Options) string {
+		commandBuf.Reset()
+		initDownload(&commandBuf)
+		for _, file := range setup.files {
+			addDownload(t, &commandBuf, file.oid, file.size)
+		}
+		finishDownload(&commandBuf)
+		stdout.Reset()
+		Serve(Config{BaseDir: newpath, Options: opts}, &commandBuf, &stdout, &stderr)
+		return stdout.String()
+	}
+	newEntries := func() int {
+		count := 0
+		storage, err := backend.NewFolder(newpath)
+		assert.Nil(t, err)
+		storage.List(func(*backend.ObjectInfo) error { count++; return nil })
+		return count
+	}
+
+	stdoutStr := download(Options{Fallbacks: []string{filepath.Join(newpath, "missing"), setup.remotepath}})
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+	}
+	assert.Equal(t, 0, newEntries(), "Nothing should be copied without backfill")
+
+	download(Options{Fallbacks: []string{setup.remotepath}, BackFill: true})
+	assert.Equal(t, len(setup.files), newEntries())
+	for _, file := range setup.files {
+		assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(newpath, file.oid)))
+	}
+
+	// Uploads only go to the main store
+	assert.Nil(t, os.RemoveAll(setup.remotepath))
+	assert.Nil(t, os.Mkdir(setup.remotepath, 0755))
+	assert.Nil(t, os.RemoveAll(newpath))
+	assert.Nil(t, os.Mkdir(newpath, 0755))
+	stdout.Reset()
+	Serve(Config{BaseDir: newpath, Options: Options{Fallbacks: []string{setup.remotepath}}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.Equal(t, len(setup.files), newEntries())
+	entries, err := ioutil.ReadDir(setup.remotepath)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRemoteBaseDirs(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	backupPath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-backup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(backupPath)
+
+	// One session pushing to origin and then to backup
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	addUpload(t, &commandBuf, setup.files[0].path, setup.files[0].oid, setup.files[0].size)
+	commandBuf.WriteString(`{ "event": "init", "operation": "upload", "remote": "backup", "concurrent": true, "concurrenttransfers": 3 }`)
+	commandBuf.WriteString("\n")
+	addUpload(t, &commandBuf, setup.files[1].path, setup.files[1].oid, setup.files[1].size)
+	finishUpload(&commandBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	opts := Options{RemoteBaseDirs: map[string]string{"backup": backupPath}}
+	Serve(Config{BaseDir: setup.remotepath, Options: opts}, &commandBuf, &stdout, &stderr)
+	assert.NotContains(t, stdout.String(), `"error"`)
+
+	assert.FileExists(t, backend.StoragePath(setup.remotepath, setup.files[0].oid))
+	assert.FileExists(t, backend.StoragePath(backupPath, setup.files[1].oid))
+	_, err = os.Stat(backend.StoragePath(backupPath, setup.files[0].oid))
+	assert.True(t, os.IsNotExist(err), "origin's object should not go to backup")
+	_, err = os.Stat(backend.StoragePath(setup.remotepath, setup.files[1].oid))
+	assert.True(t, os.IsNotExist(err), "backup's object should not go to origin")
+
+	// A remote with no base directory of its own can't be used without a
+	// default
+	stdout.Reset()
+	var initBuf bytes.Buffer
+	initUpload(&initBuf)
+	Serve(Config{Options: opts}, &initBuf, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `"code":9`)
+
+	// and neither can one whose store is missing, which isn't noticed until
+	// the remote is used
+	stdout.Reset()
+	initBuf.Reset()
+	initUpload(&initBuf)
+	missing := Options{RemoteBaseDirs: map[string]string{"origin": filepath.Join(backupPath, "missing")}}
+	Serve(Config{BaseDir: setup.remotepath, Options: missing}, &initBuf, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `"code":9`)
+}
+
+// failingBackend stops every read after a number of bytes, like a dropped
+// connection
+type failingBackend struct {
+	backend.Backend
+	after int64
+}
+
+func (b *failingBackend) Open(oid string) (io.ReadCloser, error) {
+	r, err := b.Backend.Open(oid)
+	if err != nil {
+		return nil, err
+	}
+	return &failingReader{ReadCloser: r, left: b.after}, nil
+}
+
+type failingReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, fmt.Errorf("connection lost")
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+func TestResume(t *testing.T) {
+	defer func(interval int64) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 4 * 1024 * 16 * 2
+
+	// Download, interrupted after 5 blocks so 4 are checkpointed
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	file := setup.files[1]
+	gitDir, err := gitDir()
+	assert.Nil(t, err)
+	dlfilename := downloadTempPath(gitDir, file.oid)
+	removePartialDownload(dlfilename)
+	defer removePartialDownload(dlfilename)
+
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	log := util.NewLogger(&stderr, util.LogDebug, false)
+	_, terr := retrieveFrom(&failingBackend{storage, 4 * 1024 * 16 * 5}, Options{}, nil, gitDir, file.oid, file.size, writer, log)
+	assert.NotNil(t, terr)
+	assert.Equal(t, 7, terr.Code)
+	assert.FileExists(t, dlfilename, "Partial download should be kept")
+	assert.FileExists(t, downloadStatePath(dlfilename))
+
+	stdout.Reset()
+	path, terr := retrieveFrom(storage, Options{}, nil, gitDir, file.oid, file.size, writer, log)
+	assert.Nil(t, terr)
+	writer.Flush()
+	assert.True(t, strings.HasPrefix(stdout.String(), `{"event":"progress","oid":"`+file.oid+`","bytesSoFar":262144,`), "Should resume from checkpoint")
+	assert.Equal(t, file.oid, calculateFileHash(t, path))
+	_, err = os.Stat(downloadStatePath(dlfilename))
+	assert.True(t, os.IsNotExist(err), "State should be removed once complete")
+
+	// Upload, interrupted after 3 blocks so 2 are checkpointed
+	upsetup := setupUploadTest(t)
+	defer os.RemoveAll(upsetup.localpath)
+	defer os.RemoveAll(upsetup.remotepath)
+	upfile := upsetup.files[2]
+	upstorage, err := backend.NewFolder(upsetup.remotepath)
+	assert.Nil(t, err)
+	w, state, err := createResumable(upstorage, upfile.oid, upfile.size)
+	assert.Nil(t, err)
+	src, err := os.Open(upfile.path)
+	assert.Nil(t, err)
+	_, err = copyResumable(upfile.size, io.LimitReader(src, 4*1024*16*3), w, state, func(state *resumeState) error {
+		data, err := state.encode(upfile.size)
+		assert.Nil(t, err)
+		return w.Checkpoint(data)
+	}, nil)
+	src.Close()
+	assert.NotNil(t, err)
+	assert.Nil(t, w.Suspend())
+	_, err = upstorage.Stat(upfile.oid)
+	assert.True(t, os.IsNotExist(err), "Interrupted upload must not be visible")
+
+	stdout.Reset()
+	Serve(Config{BaseDir: upsetup.remotepath}, bytes.NewReader(upsetup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"event":"progress","oid":"`+upfile.oid+`","bytesSoFar":131072,"bytesSinceLast":131072}`)
+	for _, file := range upsetup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(upsetup.remotepath, file.oid)))
+	}
+	leftovers, err := filepath.Glob(backend.StoragePath(upsetup.remotepath, upfile.oid) + ".*")
+	assert.Nil(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestFastCopy(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{FastCopy: true}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, fmt.Sprintf(`{"event":"progress","oid":"%v","bytesSoFar":%d,`, file.oid, file.size))
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, file.oid)))
+	}
+
+	var commandBuf bytes.Buffer
+	initDownload(&commandBuf)
+	for _, file := range setup.files {
+		addDownload(t, &commandBuf, file.oid, file.size)
+	}
+	finishDownload(&commandBuf)
+	stdout.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{FastCopy: true}}, &commandBuf, &stdout, &stderr)
+	stdoutStr = stdout.String()
+	gitDir, err := gitDir()
+	assert.Nil(t, err)
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, fmt.Sprintf(`{"event":"progress","oid":"%v","bytesSoFar":%d,`, file.oid, file.size))
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","path":`)
+		assert.Equal(t, file.oid, calculateFileHash(t, downloadTempPath(gitDir, file.oid)))
+	}
+
+	// A corrupt object is still caught
+	corrupt := setup.files[1]
+	f, err := os.OpenFile(backend.StoragePath(setup.remotepath, corrupt.oid), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0}, 10)
+	assert.Nil(t, err)
+	f.Close()
+	commandBuf.Reset()
+	initDownload(&commandBuf)
+	addDownload(t, &commandBuf, corrupt.oid, corrupt.size)
+	finishDownload(&commandBuf)
+	stdout.Reset()
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{FastCopy: true}}, &commandBuf, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+corrupt.oid+`","error":{"code":8`)
+}
+
+func TestLogFile(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	logPath := filepath.Join(setup.localpath, "transfer.log")
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	Serve(Config{BaseDir: setup.remotepath, Options: Options{LogJSON: true, LogFile: logPath}}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.Empty(t, stderr.String(), "Everything should go to the log file")
+
+	data, err := ioutil.ReadFile(logPath)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "Sent message", "Messages to lfs are only logged for debug")
+	completed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry["msg"] == "Transfer complete" {
+			oid, _ := entry["oid"].(string)
+			completed[oid] = true
+			assert.Equal(t, "upload", entry["operation"])
+			assert.Contains(t, entry, "size")
+			assert.Contains(t, entry, "duration_ms")
+		}
+	}
+	for _, file := range setup.files {
+		assert.True(t, completed[file.oid], "Completion of %v should be logged", file.oid)
+	}
+}
+
 type testFile struct {
 	path string
 	size int64
@@ -259,7 +968,7 @@ func TestDownload(t *testing.T) {
 	var stderr bytes.Buffer
 
 	// Perform entire sequence
-	Serve(setup.remotepath, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
 
 	// Check reported progress and completion
 	stdoutStr := stdout.String()
@@ -290,6 +999,42 @@ func TestDownload(t *testing.T) {
 
 }
 
+func TestDownloadCorrupt(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Flip a byte in the first file, truncate the second, leave the third
+	corrupt := setup.files[0]
+	f, err := os.OpenFile(corrupt.path, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0}, 10)
+	assert.Nil(t, err)
+	f.Close()
+	truncated := setup.files[1]
+	assert.Nil(t, os.Truncate(truncated.path, truncated.size-1))
+
+	// Earlier tests may have left completed downloads behind
+	gitDir, err := gitDir()
+	assert.Nil(t, err)
+	for _, file := range setup.files {
+		os.Remove(downloadTempPath(gitDir, file.oid))
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(Config{BaseDir: setup.remotepath}, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files[0:2] {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`","error":{"code":8`)
+		_, err := os.Stat(downloadTempPath(gitDir, file.oid))
+		assert.True(t, os.IsNotExist(err), "Temp file should have been removed")
+	}
+	assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+setup.files[2].oid+`","path":`)
+}
+
 func addDownload(t *testing.T, buf *bytes.Buffer, oid string, size int64) {
 	req := &api.Request{
 		Event:  "download",
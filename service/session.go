@@ -0,0 +1,113 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// session is what Serve keeps between requests. The stores for each remote
+// are opened the first time git-lfs uses it, since which base directory they
+// are in can depend on the remote.
+type session struct {
+	baseDir string
+	gitDir  string
+	opts    Options
+	log     *util.Logger
+	// uploadLimit and downloadLimit are shared by every remote
+	uploadLimit   *rateLimiter
+	downloadLimit *rateLimiter
+
+	mu      sync.Mutex
+	remotes map[string]*remoteStores
+	swept   []chan struct{}
+}
+
+// remoteStores are the stores for one remote, or why they couldn't be opened
+type remoteStores struct {
+	baseDir string
+	stores  *stores
+	err     error
+	swept   bool
+}
+
+func newSession(baseDir, gitDir string, opts Options, log *util.Logger) *session {
+	return &session{
+		baseDir:       baseDir,
+		gitDir:        gitDir,
+		opts:          opts,
+		log:           log,
+		uploadLimit:   newRateLimiter(opts.UploadLimit),
+		downloadLimit: newRateLimiter(opts.DownloadLimit),
+		remotes:       make(map[string]*remoteStores),
+	}
+}
+
+// remoteBaseDir returns the base directory to use for a remote, which is
+// baseDir unless opts.RemoteBaseDirs has one for it
+func remoteBaseDir(baseDir, remote string, opts Options) string {
+	if dir, ok := opts.RemoteBaseDirs[remote]; ok && len(remote) > 0 {
+		return dir
+	}
+	return baseDir
+}
+
+// storesFor returns the stores for a remote, opening them if this is the first
+// time it has been used
+func (s *session) storesFor(remote string) *remoteStores {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs, ok := s.remotes[remote]; ok {
+		return rs
+	}
+	rs := &remoteStores{baseDir: remoteBaseDir(s.baseDir, remote, s.opts)}
+	if len(rs.baseDir) > 0 {
+		if rs.stores, rs.err = openStores(rs.baseDir, s.gitDir, s.opts, s.log); rs.err == nil {
+			rs.stores.uploadLimit = s.uploadLimit
+			rs.stores.downloadLimit = s.downloadLimit
+		}
+	}
+	s.remotes[remote] = rs
+	return rs
+}
+
+// sweep cleans up after interrupted transfers in the stores for a remote, if
+// that hasn't been done already
+func (s *session) sweep(rs *remoteStores) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.CleanupAge <= 0 || rs.swept {
+		return
+	}
+	rs.swept = true
+	s.swept = append(s.swept, sweep(s.opts, rs.baseDir, s.gitDir, s.log))
+}
+
+// close waits for cleaning up to finish, and prunes the cache
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, done := range s.swept {
+		<-done
+	}
+	if s.opts.CacheLimit <= 0 {
+		return
+	}
+	// Caches in front of different stores can share a folder, which only
+	// needs pruning once
+	pruned := make(map[string]bool)
+	for _, rs := range s.remotes {
+		if rs.stores == nil {
+			continue
+		}
+		for _, cache := range rs.stores.caches {
+			if pruned[cache.Dir()] {
+				continue
+			}
+			pruned[cache.Dir()] = true
+			if _, _, err := cache.Prune(s.opts.CacheLimit); err != nil {
+				s.log.Warnf("Unable to prune cache %q: %v", cache.Dir(), err)
+			}
+		}
+	}
+}
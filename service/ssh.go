@@ -0,0 +1,260 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// sshStatusError is reported to the client as a failed status
+type sshStatusError struct {
+	status  int
+	message string
+}
+
+func (e *sshStatusError) Error() string {
+	return e.message
+}
+
+// ServeSSH implements the server side of the pure SSH git-lfs transfer
+// protocol (as git-lfs-transfer) for a store. operation is
+// "upload" or "download" as requested by the client; objects can only be
+// written in an upload session.
+func ServeSSH(storage backend.Backend, operation string, stdin io.Reader, stdout io.Writer) error {
+	if operation != "upload" && operation != "download" {
+		return fmt.Errorf("Invalid operation %q", operation)
+	}
+	r := api.NewPktlineReader(stdin)
+	w := api.NewPktlineWriter(stdout)
+
+	// Advertise capabilities and agree on a version
+	if err := w.WriteText("version=1"); err != nil {
+		return err
+	}
+	if err := w.WriteFlush(); err != nil {
+		return err
+	}
+	lines, _, err := r.ReadText()
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 || lines[0] != "version 1" {
+		sendSSHStatus(w, &sshStatusError{400, "Unsupported protocol version"})
+		return fmt.Errorf("Unsupported protocol version %q", lines)
+	}
+	if err := sendSSHStatus(w, nil); err != nil {
+		return err
+	}
+
+	for {
+		// <command> then args, then optionally a delim and a body
+		lines, end, err := r.ReadText()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fields := strings.Fields(lines[0])
+		args := parseSSHArgs(lines[1:])
+		hasBody := end == api.PktDelim
+
+		var cmdErr error
+		switch {
+		case len(fields) == 0:
+			cmdErr = &sshStatusError{400, "Missing command"}
+		case fields[0] == "quit":
+			return sendSSHStatus(w, nil)
+		case fields[0] == "batch":
+			cmdErr = sshBatch(storage, operation, r, w, hasBody)
+			if cmdErr == nil {
+				continue
+			}
+		case len(fields) == 2 && fields[0] == "put-object" && backend.ValidOid(fields[1]):
+			if operation != "upload" {
+				cmdErr = &sshStatusError{403, "Objects can only be written during upload"}
+				if hasBody {
+					// read and discard the data so the stream can continue
+					io.Copy(ioutil.Discard, r.DataReader())
+				}
+				break
+			}
+			cmdErr = sshPutObject(storage, fields[1], args, r, hasBody)
+		case len(fields) == 2 && fields[0] == "verify-object" && backend.ValidOid(fields[1]):
+			cmdErr = sshVerifyObject(storage, fields[1], args)
+		case len(fields) == 2 && fields[0] == "get-object" && backend.ValidOid(fields[1]):
+			cmdErr = sshGetObject(storage, fields[1], w)
+			if cmdErr == nil {
+				continue
+			}
+		case fields[0] == "lock" || fields[0] == "list-lock" || fields[0] == "unlock":
+			cmdErr = &sshStatusError{404, "Locking is not supported"}
+		default:
+			cmdErr = &sshStatusError{400, fmt.Sprintf("Unknown command %q", lines[0])}
+		}
+		if status, ok := cmdErr.(*sshStatusError); ok && status.status == 400 && hasBody {
+			// Skip whatever came with it so the next command can be read
+			io.Copy(ioutil.Discard, r.DataReader())
+		}
+		if _, ok := cmdErr.(*sshStatusError); cmdErr != nil && !ok {
+			// Protocol or I/O failure, can't carry on
+			return cmdErr
+		}
+		if err := sendSSHStatus(w, cmdErr); err != nil {
+			return err
+		}
+	}
+}
+
+func parseSSHArgs(lines []string) map[string]string {
+	args := make(map[string]string)
+	for _, line := range lines {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			args[parts[0]] = parts[1]
+		}
+	}
+	return args
+}
+
+// sendSSHStatus reports success, or the failure in err
+func sendSSHStatus(w *api.PktlineWriter, err error) error {
+	if err == nil {
+		if err := w.WriteText("status 200"); err != nil {
+			return err
+		}
+		return w.WriteFlush()
+	}
+	status := 500
+	if statusErr, ok := err.(*sshStatusError); ok {
+		status = statusErr.status
+	}
+	if err := w.WriteText(fmt.Sprintf("status %d", status)); err != nil {
+		return err
+	}
+	if err := w.WriteDelim(); err != nil {
+		return err
+	}
+	if err := w.WriteText(err.Error()); err != nil {
+		return err
+	}
+	return w.WriteFlush()
+}
+
+func sshBatch(storage backend.Backend, operation string, r *api.PktlineReader, w *api.PktlineWriter, hasBody bool) error {
+	var objects []string
+	if hasBody {
+		var err error
+		if objects, _, err = r.ReadText(); err != nil {
+			return err
+		}
+	}
+
+	var results []string
+	for _, line := range objects {
+		// <oid> <size>
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !backend.ValidOid(fields[0]) {
+			return &sshStatusError{400, fmt.Sprintf("Invalid object %q", line)}
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return &sshStatusError{400, fmt.Sprintf("Invalid object %q", line)}
+		}
+		info, err := storage.Stat(fields[0])
+		exists := err == nil && info.Size == size
+
+		action := "noop"
+		if operation == "download" && exists {
+			action = "download"
+		} else if operation == "upload" && !exists {
+			action = "upload"
+		}
+		results = append(results, fmt.Sprintf("%v %d %v", fields[0], size, action))
+	}
+
+	if err := w.WriteText("status 200", "hash-algo=sha256", "transfer=basic"); err != nil {
+		return err
+	}
+	if err := w.WriteDelim(); err != nil {
+		return err
+	}
+	if err := w.WriteText(results...); err != nil {
+		return err
+	}
+	return w.WriteFlush()
+}
+
+func sshPutObject(storage backend.Backend, oid string, args map[string]string, r *api.PktlineReader, hasBody bool) error {
+	if !hasBody {
+		return &sshStatusError{400, "No object data"}
+	}
+	data := r.DataReader()
+	size, err := strconv.ParseInt(args["size"], 10, 64)
+	if err != nil {
+		io.Copy(ioutil.Discard, data)
+		return &sshStatusError{400, "Invalid or missing size"}
+	}
+	unlock, err := backend.Lock(storage, oid)
+	if err != nil {
+		io.Copy(ioutil.Discard, data)
+		return &sshStatusError{500, err.Error()}
+	}
+	defer unlock()
+	// Content is verified against the oid, so that covers the size too
+	err = writeObject(storage, oid, size, data)
+	if _, ok := err.(*contentMismatchError); ok {
+		return &sshStatusError{422, err.Error()}
+	} else if err != nil {
+		// finish reading so we're in a position to report it
+		io.Copy(ioutil.Discard, data)
+		return &sshStatusError{500, err.Error()}
+	}
+	return nil
+}
+
+func sshVerifyObject(storage backend.Backend, oid string, args map[string]string) error {
+	size, err := strconv.ParseInt(args["size"], 10, 64)
+	if err != nil {
+		return &sshStatusError{400, "Invalid or missing size"}
+	}
+	info, err := storage.Stat(oid)
+	if err != nil {
+		return &sshStatusError{404, "Object does not exist"}
+	}
+	if info.Size != size {
+		return &sshStatusError{422, fmt.Sprintf("Object is %d bytes, expected %d", info.Size, size)}
+	}
+	return nil
+}
+
+func sshGetObject(storage backend.Backend, oid string, w *api.PktlineWriter) error {
+	info, err := storage.Stat(oid)
+	if err != nil {
+		return &sshStatusError{404, "Object does not exist"}
+	}
+	f, err := storage.Open(oid)
+	if err != nil {
+		return &sshStatusError{404, "Object does not exist"}
+	}
+	defer f.Close()
+
+	if err := w.WriteText("status 200", fmt.Sprintf("size=%d", info.Size)); err != nil {
+		return err
+	}
+	if err := w.WriteDelim(); err != nil {
+		return err
+	}
+	// A corrupt object fails part way through, which ends the connection
+	if err := w.WriteData(newVerifiedReader(f, oid, info.Size)); err != nil {
+		return err
+	}
+	return w.WriteFlush()
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeSSH(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	storage, err := backend.NewFolder(setup.remotepath)
+	assert.Nil(t, err)
+
+	file := setup.files[2]
+	content, err := ioutil.ReadFile(file.path)
+	assert.Nil(t, err)
+	objectLine := fmt.Sprintf("%v %d", file.oid, file.size)
+
+	// Client side of an upload session, sent all at once
+	var in bytes.Buffer
+	w := api.NewPktlineWriter(&in)
+	w.WriteText("version 1")
+	w.WriteFlush()
+	w.WriteText("batch", "transfer=basic", "hash-algo=sha256")
+	w.WriteDelim()
+	w.WriteText(objectLine)
+	w.WriteFlush()
+	w.WriteText("put-object "+file.oid, fmt.Sprintf("size=%d", file.size))
+	w.WriteDelim()
+	w.WriteData(bytes.NewReader(content))
+	w.WriteFlush()
+	w.WriteText("verify-object "+file.oid, fmt.Sprintf("size=%d", file.size))
+	w.WriteFlush()
+	w.WriteText("batch")
+	w.WriteDelim()
+	w.WriteText(objectLine)
+	w.WriteFlush()
+	w.WriteText("lock", "path=foo")
+	w.WriteFlush()
+	w.WriteText("quit")
+	w.WriteFlush()
+
+	var out bytes.Buffer
+	assert.Nil(t, ServeSSH(storage, "upload", &in, &out))
+	assert.Equal(t, file.oid, calculateFileHash(t, backend.StoragePath(setup.remotepath, file.oid)))
+
+	r := api.NewPktlineReader(&out)
+	expect := func(want []string, wantEnd int) {
+		lines, end, err := r.ReadText()
+		assert.Nil(t, err)
+		assert.Equal(t, want, lines)
+		assert.Equal(t, wantEnd, end)
+	}
+	expect([]string{"version=1"}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+	// batch
+	expect([]string{"status 200", "hash-algo=sha256", "transfer=basic"}, api.PktDelim)
+	expect([]string{objectLine + " upload"}, api.PktFlush)
+	// put-object, verify-object
+	expect([]string{"status 200"}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+	// batch again, already have it
+	expect([]string{"status 200", "hash-algo=sha256", "transfer=basic"}, api.PktDelim)
+	expect([]string{objectLine + " noop"}, api.PktFlush)
+	// lock
+	expect([]string{"status 404"}, api.PktDelim)
+	expect([]string{"Locking is not supported"}, api.PktFlush)
+	// quit
+	expect([]string{"status 200"}, api.PktFlush)
+
+	// Now download it again
+	in.Reset()
+	w.WriteText("version 1")
+	w.WriteFlush()
+	w.WriteText("get-object " + file.oid)
+	w.WriteFlush()
+	w.WriteText("put-object "+file.oid, fmt.Sprintf("size=%d", file.size))
+	w.WriteDelim()
+	w.WriteData(bytes.NewReader(content))
+	w.WriteFlush()
+	w.WriteText("quit")
+	w.WriteFlush()
+
+	out.Reset()
+	assert.Nil(t, ServeSSH(storage, "download", &in, &out))
+	r = api.NewPktlineReader(&out)
+	expect([]string{"version=1"}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+	expect([]string{"status 200", fmt.Sprintf("size=%d", file.size)}, api.PktDelim)
+	downloaded, err := ioutil.ReadAll(r.DataReader())
+	assert.Nil(t, err)
+	assert.Equal(t, content, downloaded)
+	// writes aren't allowed when downloading
+	expect([]string{"status 403"}, api.PktDelim)
+	expect([]string{"Objects can only be written during upload"}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+}
+
+func TestServeSSHMalformed(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+	storage, err := backend.NewFolder(storepath)
+	assert.Nil(t, err)
+
+	var in bytes.Buffer
+	w := api.NewPktlineWriter(&in)
+	w.WriteText("version 1")
+	w.WriteFlush()
+	w.WriteText("")
+	w.WriteFlush()
+	w.WriteText("   ", "size=1")
+	w.WriteDelim()
+	w.WriteData(bytes.NewReader([]byte("ignored")))
+	w.WriteFlush()
+	w.WriteText("put-object not-an-oid")
+	w.WriteFlush()
+	w.WriteText("quit")
+	w.WriteFlush()
+
+	var out bytes.Buffer
+	assert.Nil(t, ServeSSH(storage, "upload", &in, &out))
+	r := api.NewPktlineReader(&out)
+	expect := func(want []string, wantEnd int) {
+		lines, end, err := r.ReadText()
+		assert.Nil(t, err)
+		assert.Equal(t, want, lines)
+		assert.Equal(t, wantEnd, end)
+	}
+	expect([]string{"version=1"}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+	// blank, then whitespace with a body which is skipped
+	expect([]string{"status 400"}, api.PktDelim)
+	expect([]string{"Missing command"}, api.PktFlush)
+	expect([]string{"status 400"}, api.PktDelim)
+	expect([]string{"Missing command"}, api.PktFlush)
+	expect([]string{"status 400"}, api.PktDelim)
+	expect([]string{`Unknown command "put-object not-an-oid"`}, api.PktFlush)
+	expect([]string{"status 200"}, api.PktFlush)
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+)
+
+// Kinds of problem which can be found by Verify
+const (
+	ProblemCorrupt    = "corrupt"    // content does not match oid
+	ProblemMisplaced  = "misplaced"  // object is not where its oid says it should be
+	ProblemNotRegular = "notregular" // object is a directory, symlink etc
+	ProblemEmpty      = "empty"      // object has no content
+	ProblemTempFile   = "tempfile"   // temp file left by an interrupted upload
+	ProblemUnexpected = "unexpected" // file which has nothing to do with the store
+	ProblemUnreadable = "unreadable" // file could not be read to check it
+)
+
+// Oid of an object with no content, which is the only valid empty object
+const emptyOid = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// VerifyProblem describes a single issue found in the store
+type VerifyProblem struct {
+	Path    string `json:"path"`
+	Oid     string `json:"oid,omitempty"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// VerifyReport is the result of auditing an entire store
+type VerifyReport struct {
+	BaseDir    string          `json:"basedir"`
+	Objects    int             `json:"objects"`
+	Bytes      int64           `json:"bytes"`
+	Chunks     int             `json:"chunks"`
+	ChunkBytes int64           `json:"chunkbytes"`
+	Problems   []VerifyProblem `json:"problems"`
+}
+
+// OK returns whether no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+type verifyJob struct {
+	path string
+	oid  string
+}
+
+// Verify audits every file in the store at baseDir, re-hashing objects using
+// the given number of parallel workers. Encrypted objects need the key to be
+// checked. Chunked objects are reassembled to check them, so chunks are only
+// checked for where they are. An error is only returned if the store could not
+// be walked at all; everything else is reported as a problem.
+func Verify(baseDir string, key []byte, workers int) (*VerifyReport, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	report := &VerifyReport{BaseDir: baseDir, Problems: []VerifyProblem{}}
+	var mu sync.Mutex
+	addProblem := func(p VerifyProblem) {
+		mu.Lock()
+		report.Problems = append(report.Problems, p)
+		mu.Unlock()
+	}
+
+	// Objects may be stored compressed, encrypted or chunked, it's the content
+	// which has to match
+	objects, err := OpenStore(baseDir, Options{EncryptionKey: key})
+	if err != nil {
+		return nil, err
+	}
+	chunksDir := filepath.Join(baseDir, backend.ChunksNamespace)
+	jobs := make(chan verifyJob, workers*2)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hash, err := objectHash(objects, job.oid)
+				if _, ok := err.(*backend.CorruptObjectError); ok {
+					addProblem(VerifyProblem{job.path, job.oid, ProblemCorrupt, err.Error()})
+				} else if err != nil {
+					addProblem(VerifyProblem{job.path, job.oid, ProblemUnreadable, err.Error()})
+				} else if hash != job.oid {
+					addProblem(VerifyProblem{job.path, job.oid, ProblemCorrupt, "content has SHA-256 " + hash})
+				}
+			}
+		}()
+	}
+
+	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == baseDir {
+				return err
+			}
+			addProblem(VerifyProblem{path, "", ProblemUnreadable, err.Error()})
+			return nil
+		}
+		if path == baseDir {
+			return nil
+		}
+
+		name := info.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			// Temp files of an upload which is still running aren't left over
+			if len(name) <= 64 || !backend.ValidOid(name[:64]) || !backend.Locked(filepath.Join(filepath.Dir(path), name[:64])) {
+				addProblem(VerifyProblem{Path: path, Problem: ProblemTempFile})
+			}
+		case strings.HasSuffix(name, backend.ChecksumSuffix) && backend.ValidOid(strings.TrimSuffix(name, backend.ChecksumSuffix)):
+			// sidecars are only trusted if they match the object, nothing to check
+		case strings.HasSuffix(name, backend.LockSuffix) && backend.ValidOid(strings.TrimSuffix(name, backend.LockSuffix)):
+			// an upload in progress, or an abandoned one which will be taken over
+		case (name == AuditLogName || name == AuditLogName+backend.LockSuffix) && path == filepath.Join(baseDir, name):
+			// the audit log isn't an object
+		case backend.ValidOid(name):
+			isChunk := strings.HasPrefix(path, chunksDir+string(filepath.Separator))
+			expected := backend.StoragePath(baseDir, name)
+			if isChunk {
+				expected = backend.StoragePath(chunksDir, name)
+			}
+			if path != expected {
+				addProblem(VerifyProblem{Path: path, Oid: name, Problem: ProblemMisplaced, Detail: "should be at " + expected})
+			} else if !info.Mode().IsRegular() {
+				addProblem(VerifyProblem{Path: path, Oid: name, Problem: ProblemNotRegular, Detail: info.Mode().String()})
+			} else if info.Size() == 0 && name != emptyOid {
+				addProblem(VerifyProblem{Path: path, Oid: name, Problem: ProblemEmpty})
+			} else if isChunk {
+				// Chunks are checked as part of the objects which use them
+				report.Chunks++
+				report.ChunkBytes += info.Size()
+			} else {
+				report.Objects++
+				report.Bytes += info.Size()
+				jobs <- verifyJob{path, name}
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		case info.IsDir():
+			// Layout is xx/yy/oid, anything else is left alone but still searched
+		default:
+			addProblem(VerifyProblem{Path: path, Problem: ProblemUnexpected})
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+	return report, nil
+}
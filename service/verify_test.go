@@ -0,0 +1,83 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sinbad/lfs-folderstore/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	storepath, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-remote")
+	assert.Nil(t, err, "Error creating temp shared path")
+	defer os.RemoveAll(storepath)
+
+	// Put a number of good objects in the store
+	addObject := func(name string, size int64) string {
+		path := filepath.Join(storepath, name)
+		oid := createTestFile(t, size, path)
+		dest := backend.StoragePath(storepath, oid)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(dest), 0755))
+		assert.Nil(t, os.Rename(path, dest))
+		return oid
+	}
+	for i, size := range []int64{10, 3000, 4*1024*16*3 + 12} {
+		addObject(string('a'+rune(i)), size)
+	}
+
+	report, err := Verify(storepath, nil, 2)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Objects)
+
+	// Now break things in all the ways we know about
+	corruptOid := addObject("corrupt", 1234)
+	assert.Nil(t, ioutil.WriteFile(backend.StoragePath(storepath, corruptOid), make([]byte, 1234), 0644))
+
+	misplacedOid := addObject("misplaced", 999)
+	misplacedPath := filepath.Join(storepath, misplacedOid)
+	assert.Nil(t, os.Rename(backend.StoragePath(storepath, misplacedOid), misplacedPath))
+
+	zeroOid := addObject("empty", 100)
+	assert.Nil(t, os.Truncate(backend.StoragePath(storepath, zeroOid), 0))
+
+	dirOid := addObject("dir", 100)
+	assert.Nil(t, os.Remove(backend.StoragePath(storepath, dirOid)))
+	assert.Nil(t, os.Mkdir(backend.StoragePath(storepath, dirOid), 0755))
+
+	tempPath := backend.StoragePath(storepath, corruptOid) + ".tmp"
+	assert.Nil(t, ioutil.WriteFile(tempPath, []byte("partial"), 0644))
+
+	// but not those of an upload which is still running
+	uploadingOid := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	unlock, err := backend.LockPath(backend.StoragePath(storepath, uploadingOid))
+	assert.Nil(t, err)
+	defer unlock()
+	for _, suffix := range []string{".123.tmp", ".partial.tmp", ".state.tmp"} {
+		assert.Nil(t, ioutil.WriteFile(backend.StoragePath(storepath, uploadingOid)+suffix, []byte("partial"), 0644))
+	}
+
+	unexpectedPath := filepath.Join(storepath, "notes.txt")
+	assert.Nil(t, ioutil.WriteFile(unexpectedPath, []byte("hello"), 0644))
+
+	report, err = Verify(storepath, nil, 2)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 4, report.Objects)
+
+	found := make(map[string]string)
+	for _, p := range report.Problems {
+		found[p.Path] = p.Problem
+	}
+	assert.Equal(t, map[string]string{
+		backend.StoragePath(storepath, corruptOid): ProblemCorrupt,
+		misplacedPath:                           ProblemMisplaced,
+		backend.StoragePath(storepath, zeroOid): ProblemEmpty,
+		backend.StoragePath(storepath, dirOid):  ProblemNotRegular,
+		tempPath:                                ProblemTempFile,
+		unexpectedPath:                          ProblemUnexpected,
+	}, found)
+}
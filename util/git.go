@@ -0,0 +1,140 @@
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// GitConfigGet returns the value of a git config key, or blank if not set
+func GitConfigGet(key string) (string, error) {
+	cmd := NewCmd("git", "config", "--get", key)
+	out, err := cmd.Output()
+	if err != nil {
+		// Exit code 1 means the key isn't set, that's fine
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed to call git config --get %v: %v", key, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GitConfigValues returns every value of the git config keys matching a
+// regex, in the order git reads them. Keys are as git reports them, so section
+// and variable names are lower case. If file is not blank, only that file is
+// read, e.g. .lfsconfig.
+func GitConfigValues(file, keyRegex string) (map[string][]string, error) {
+	args := []string{"config"}
+	if len(file) > 0 {
+		args = append(args, "--file", file)
+	}
+	args = append(args, "--get-regexp", keyRegex)
+	cmd := NewCmd("git", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		// Exit code 1 means nothing matched
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return map[string][]string{}, nil
+		}
+		return nil, fmt.Errorf("Failed to call git config --get-regexp %v: %v", keyRegex, err)
+	}
+	values := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = append(values[parts[0]], parts[1])
+		} else if len(parts[0]) > 0 {
+			// A key with no value, which means true
+			values[parts[0]] = append(values[parts[0]], "")
+		}
+	}
+	return values, nil
+}
+
+// GitTopLevel returns the top level folder of the working tree of the current
+// repository
+func GitTopLevel() (string, error) {
+	cmd := NewCmd("git", "rev-parse", "--show-toplevel")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to call git rev-parse --show-toplevel: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GitConfigSet sets a git config key in the local repository, replacing any
+// existing values so that it's safe to call repeatedly
+func GitConfigSet(key, value string) error {
+	cmd := NewCmd("git", "config", "--local", "--replace-all", key, value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to call git config %v: %v %v", key, err, string(out))
+	}
+	return nil
+}
+
+// GitConfigUnset removes all values of a git config key in the local
+// repository. If valueRegex is not blank, only matching values are removed.
+// It is not an error for the key not to exist.
+func GitConfigUnset(key, valueRegex string) error {
+	args := []string{"config", "--local", "--unset-all", key}
+	if len(valueRegex) > 0 {
+		args = append(args, valueRegex)
+	}
+	cmd := NewCmd("git", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// Exit code 5 means there was nothing to unset
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			return nil
+		}
+		return fmt.Errorf("Failed to call git config --unset-all %v: %v %v", key, err, string(out))
+	}
+	return nil
+}
+
+var safeArgRegex = regexp.MustCompile(`^[A-Za-z0-9/._\-:+,=@]+$`)
+
+// QuoteArg quotes a value so that git-lfs will pass it to a custom transfer
+// agent as a single argument even if it contains spaces or shell characters.
+// git-lfs splits the args on spaces outside single or double quotes, and has
+// no escapes, so a value with both kinds of quote, or a line break, can't be
+// passed at all.
+func QuoteArg(arg string) (string, error) {
+	switch {
+	case safeArgRegex.MatchString(arg):
+		return arg, nil
+	case strings.ContainsAny(arg, "\r\n"):
+		return "", fmt.Errorf("%q contains a line break, which git-lfs cannot pass to a transfer agent", arg)
+	case !strings.Contains(arg, "'"):
+		return "'" + arg + "'", nil
+	case !strings.Contains(arg, `"`):
+		return `"` + arg + `"`, nil
+	}
+	return "", fmt.Errorf("%q contains both single and double quotes, which git-lfs cannot pass to a transfer agent", arg)
+}
+
+// GitConfigLocalKeys returns the local git config keys matching a regex, with
+// their values
+func GitConfigLocalKeys(keyRegex string) (map[string]string, error) {
+	cmd := NewCmd("git", "config", "--local", "--get-regexp", keyRegex)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("Failed to call git config --get-regexp %v: %v", keyRegex, err)
+	}
+	keys := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			keys[parts[0]] = parts[1]
+		} else if len(parts[0]) > 0 {
+			keys[parts[0]] = ""
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+var quotedFieldRegex = regexp.MustCompile("'(.*)'|\"(.*)\"|(\\S*)")
+
+// quotedFields splits the args of a custom transfer agent in the same way as
+// git-lfs (tools.QuotedFields)
+func quotedFields(s string) []string {
+	var fields []string
+	for _, matches := range quotedFieldRegex.FindAllStringSubmatch(s, -1) {
+		if len(matches[0]) == 0 {
+			continue
+		}
+		var field string
+		for _, m := range matches[1:] {
+			if len(m) > 0 {
+				field = m
+				break
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestQuoteArg(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    string
+		wantErr bool
+	}{
+		{name: "Plain", arg: "C:/Storage/Dir", want: "C:/Storage/Dir"},
+		{name: "Spaces", arg: "C:/Storage Path/Dir", want: "'C:/Storage Path/Dir'"},
+		{name: "Shell characters", arg: "/mnt/a&b $HOME\\x", want: "'/mnt/a&b $HOME\\x'"},
+		{name: "Double quote", arg: `/mnt/"quoted" dir`, want: `'/mnt/"quoted" dir'`},
+		{name: "Single quote", arg: "/home/bob's stuff", want: `"/home/bob's stuff"`},
+		{name: "Single quote and backslash", arg: `/home/bob's \stuff`, want: `"/home/bob's \stuff"`},
+		{name: "Single and double quote", arg: `/a'b"c`, wantErr: true},
+		{name: "Line break", arg: "/a\nb", wantErr: true},
+		{name: "Empty", arg: "", want: "''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QuoteArg(tt.arg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("QuoteArg() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("QuoteArg() = %v, %v, want %v", got, err, tt.want)
+			}
+			// git-lfs has to get back exactly what was quoted
+			if fields := quotedFields(got); !reflect.DeepEqual(fields, []string{tt.arg}) {
+				t.Errorf("git-lfs would split %v into %q", got, fields)
+			}
+		})
+	}
+}
+
+func TestGitConfigValues(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "lfs-folderstore-test-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, ".lfsconfig")
+	for _, args := range [][]string{
+		{"lfs-folderstore.baseDir", "/store"},
+		{"--add", "lfs-folderstore.mirror", "/mirror1"},
+		{"--add", "lfs-folderstore.mirror", "/mirror 2"},
+		{"lfs-folderstore.Backup.basedir", "/backup"},
+		{"lfs.url", "https://example.com"},
+	} {
+		if out, err := exec.Command("git", append([]string{"config", "--file", file}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git config %v: %v %v", args, err, string(out))
+		}
+	}
+
+	got, err := GitConfigValues(file, `^lfs-folderstore\.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"lfs-folderstore.basedir":        {"/store"},
+		"lfs-folderstore.mirror":         {"/mirror1", "/mirror 2"},
+		"lfs-folderstore.Backup.basedir": {"/backup"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GitConfigValues() = %v, want %v", got, want)
+	}
+
+	got, err = GitConfigValues(file, `^nothing\.`)
+	if err != nil || len(got) != 0 {
+		t.Errorf("GitConfigValues() = %v, %v, want nothing", got, err)
+	}
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is how important a log entry is, higher levels being more verbose
+type LogLevel int
+
+// Log levels, from least to most verbose
+const (
+	LogError LogLevel = iota + 1
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = []string{"", "error", "warn", "info", "debug"}
+
+func (l LogLevel) String() string {
+	if l < LogError || l > LogDebug {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses the name of a log level, e.g. "debug"
+func ParseLogLevel(s string) (LogLevel, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, n := range logLevelNames {
+		if i > 0 && n == name {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid log level %q, must be error, warn, info or debug", s)
+}
+
+// Fields are values attached to log entries, e.g. which object they're about
+type Fields map[string]interface{}
+
+// logOutput is shared by a Logger and everything derived from it with With
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+// Logger writes log entries of at least a given level, one per line, as text
+// or JSON. It can be used from any number of goroutines at once.
+type Logger struct {
+	out    *logOutput
+	fields Fields
+}
+
+// NewLogger creates a logger writing to w. A level of 0 means LogInfo.
+func NewLogger(w io.Writer, level LogLevel, asJSON bool) *Logger {
+	if level == 0 {
+		level = LogInfo
+	}
+	return &Logger{out: &logOutput{w: w, level: level, json: asJSON}}
+}
+
+// With returns a logger which adds fields to every entry, as well as any this
+// one already adds
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, fields: merged}
+}
+
+// Enabled returns whether entries of a level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level <= l.out.level
+}
+
+// Errorf logs an error
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Logf(LogError, format, args...)
+}
+
+// Warnf logs a warning
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Logf(LogWarn, format, args...)
+}
+
+// Infof logs information
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Logf(LogInfo, format, args...)
+}
+
+// Debugf logs detail which is only useful for debugging
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.Logf(LogDebug, format, args...)
+}
+
+// Logf logs a message at any level
+func (l *Logger) Logf(level LogLevel, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	now := time.Now().Format(time.RFC3339)
+	var line []byte
+	if l.out.json {
+		entry := make(Fields, len(l.fields)+3)
+		for k, v := range l.fields {
+			entry[k] = v
+		}
+		entry["time"] = now
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			line, _ = json.Marshal(Fields{"time": now, "level": level.String(), "msg": msg})
+		}
+	} else {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%v %v %v", now, level, msg)
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value := fmt.Sprint(l.fields[k])
+			if strings.ContainsAny(value, " \t\"=") {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&buf, " %v=%v", k, value)
+		}
+		line = buf.Bytes()
+	}
+	line = append(line, '\n')
+
+	l.out.mu.Lock()
+	l.out.w.Write(line)
+	l.out.mu.Unlock()
+}
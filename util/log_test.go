@@ -0,0 +1,64 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, LogWarn, false).With(Fields{"oid": "abc", "path": "a b"})
+	log.Infof("not written")
+	log.Warnf("written %d", 1)
+	line := strings.TrimSpace(buf.String())
+	if strings.Contains(line, "not written") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Only entries at or above the level should be written, got %q", buf.String())
+	}
+	if !strings.HasSuffix(line, ` warn written 1 oid=abc path="a b"`) {
+		t.Errorf("Unexpected text entry %q", line)
+	}
+
+	buf.Reset()
+	log = NewLogger(&buf, 0, true).With(Fields{"oid": "abc"})
+	log.With(Fields{"code": 8}).Errorf("failed")
+	log.Debugf("not written")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Entry should be one JSON object, got %q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]interface{}{"level": "error", "msg": "failed", "oid": "abc", "code": float64(8)} {
+		if entry[k] != v {
+			t.Errorf("Entry %v = %v, want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("Entry should have a time")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    LogLevel
+		wantErr bool
+	}{
+		{arg: "error", want: LogError},
+		{arg: "Warning", want: LogWarn},
+		{arg: " info ", want: LogInfo},
+		{arg: "DEBUG", want: LogDebug},
+		{arg: "", wantErr: true},
+		{arg: "trace", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, err := ParseLogLevel(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			} else if got != tt.want {
+				t.Errorf("ParseLogLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a number of bytes, which can have a K, M, G or T suffix
+// (optionally followed by B) for binary multiples, e.g. 500M or 20GB
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	multiplier := int64(1)
+	if len(str) > 0 {
+		if i := strings.IndexByte("KMGT", str[len(str)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			str = str[:len(str)-1]
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
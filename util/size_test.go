@@ -0,0 +1,33 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    int64
+		wantErr bool
+	}{
+		{name: "Bytes", arg: "1234", want: 1234},
+		{name: "Kilobytes", arg: "4K", want: 4096},
+		{name: "Megabytes", arg: "500MB", want: 500 * 1024 * 1024},
+		{name: "Gigabytes lower case", arg: "20g", want: 20 * 1024 * 1024 * 1024},
+		{name: "Terabytes", arg: " 1T ", want: 1024 * 1024 * 1024 * 1024},
+		{name: "Empty", arg: "", wantErr: true},
+		{name: "Negative", arg: "-5M", wantErr: true},
+		{name: "Unknown suffix", arg: "5X", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSize(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSize() error = %v, wantErr %v", err, tt.wantErr)
+			} else if got != tt.want {
+				t.Errorf("ParseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}